@@ -2,11 +2,14 @@ package main
 
 import (
 	"bytes"
+	"encoding/json"
 	"errors"
 	"io/ioutil"
 	"log"
 	"os"
 	"os/exec"
+	"sort"
+	"strings"
 	"sync"
 
 	"github.com/flynn/go-shlex"
@@ -52,6 +55,62 @@ type Config struct {
 	validateCmd    string
 	reloadCmd      string
 	lastValidBytes []byte
+	deps           Dependencies
+	watching       map[Dependency]bool
+	origin         *Config
+}
+
+// Dependencies maps everything a render read to the paths of the macros that
+// read it.
+type Dependencies map[Dependency][]string
+
+func dependenciesOf(calls []*MacroCall) Dependencies {
+	deps := make(Dependencies)
+	for _, call := range calls {
+		for _, dep := range call.Keys {
+			paths := deps[dep]
+			if !containsPath(paths, call.Path) {
+				deps[dep] = append(paths, call.Path)
+			}
+		}
+	}
+	for _, paths := range deps {
+		sort.Strings(paths)
+	}
+	return deps
+}
+
+func containsPath(paths []string, path string) bool {
+	for _, p := range paths {
+		if p == path {
+			return true
+		}
+	}
+	return false
+}
+
+// MarshalJSON lists the dependencies in order, each with the paths that
+// depend on it, as they cannot be the keys of an object.
+func (d Dependencies) MarshalJSON() ([]byte, error) {
+	type dependent struct {
+		Dependency
+		Paths []string `json:"paths"`
+	}
+	list := make([]dependent, 0, len(d))
+	for dep, paths := range d {
+		list = append(list, dependent{dep, paths})
+	}
+	sort.Slice(list, func(i, j int) bool {
+		a, b := list[i].Dependency, list[j].Dependency
+		if a.Kind != b.Kind {
+			return a.Kind < b.Kind
+		}
+		if a.Name != b.Name {
+			return a.Name < b.Name
+		}
+		return a.Tag < b.Tag
+	})
+	return json.Marshal(list)
 }
 
 func NewConfig(store ConfigStore, target, transform, reload, validate string) (*Config, error) {
@@ -77,7 +136,7 @@ func NewConfig(store ConfigStore, target, transform, reload, validate string) (*
 		reloadCmd:    reload,
 		validateCmd:  validate,
 	}
-	loadBuiltinMacros(config.preprocessor, store, config)
+	loadBuiltinMacros(config.preprocessor, store)
 	return config, nil
 }
 
@@ -123,6 +182,7 @@ func (c *Config) Mutate(mutation func(*JsonTree) bool) error {
 	}
 
 	c.replaceTree(cc)
+	c.watch(c.deps)
 	return c.applyAndReload(cc.lastValidBytes)
 }
 
@@ -134,12 +194,16 @@ func (c *Config) Update() error {
 	if err := cc.store.Pull(cc); err != nil {
 		return err
 	}
-	output, err := cc.renderAndValidate()
+	output, err := cc.renderAndValidate(false)
 	if err != nil {
+		// the stored config changed regardless, so watch what it depends on
+		// for changes that may fix it
+		c.watch(c.deps, cc.deps)
 		return err
 	}
 
 	c.replaceTree(cc)
+	c.watch(c.deps)
 	err = c.applyAndReload(output)
 	if err != nil {
 		return err
@@ -147,9 +211,11 @@ func (c *Config) Update() error {
 	return nil
 }
 
+// TriggerUpdate updates the config a watch was started for. Watches started
+// while pulling into a copy update the config it was copied from instead.
 func (c *Config) TriggerUpdate(from string) {
 	log.Println("config: update triggered by", from)
-	err := c.Update()
+	err := c.live().Update()
 	if err != nil {
 		log.Println("config: update failed, ignoring")
 		return
@@ -158,11 +224,61 @@ func (c *Config) TriggerUpdate(from string) {
 }
 
 func (c *Config) Validate() error {
-	_, err := c.renderAndValidate()
+	_, err := c.renderAndValidate(false)
 	return err
 }
 
+// ValidateSandboxed is Validate for a config from outside the store, such as
+// one posted to try out, whose render is shown to whoever sent it. So it is
+// rendered like Eval, with anything derived from a secret redacted and
+// macros reading the process environment or local files failing.
+func (c *Config) ValidateSandboxed() error {
+	_, err := c.renderAndValidate(true)
+	return err
+}
+
+// Eval preprocesses value on its own against the store, leaving the config
+// untouched, and returns the result with anything derived from a secret
+// redacted. Being arbitrary input, it may not read the process environment
+// or local files, even as the keys of a FileStore.
+func (c *Config) Eval(value interface{}) (interface{}, error) {
+	tree, err := c.preprocessor.ReportSandboxed(&JsonTree{root: value})
+	return tree.Get("/"), err
+}
+
+// Preprocessed returns the value at path in the config once preprocessed,
+// with anything derived from a secret redacted. If annotate is set, it also
+// returns the macros called at or below path, to show where values came from.
+func (c *Config) Preprocessed(path string, annotate bool) (interface{}, []*MacroCall, error) {
+	return c.preprocessed(path, annotate, false)
+}
+
+// Trace is Preprocessed with annotations that also show what each macro was
+// called with and resolved to, and whether its default was used.
+func (c *Config) Trace(path string) (interface{}, []*MacroCall, error) {
+	return c.preprocessed(path, true, true)
+}
+
+func (c *Config) preprocessed(path string, annotate, trace bool) (interface{}, []*MacroCall, error) {
+	c.Lock()
+	defer c.Unlock()
+	tree, calls, err := c.preprocessor.Report(c.tree, trace)
+	if !annotate {
+		calls = nil
+	}
+	prefix := strings.TrimSuffix(path, "/") + "/"
+	annotations := make([]*MacroCall, 0)
+	for _, call := range calls {
+		if call.Path == path || strings.HasPrefix(call.Path, prefix) {
+			annotations = append(annotations, call)
+		}
+	}
+	return tree.Get(path), annotations, err
+}
+
 func (c *Config) LastRender() []byte {
+	c.Lock()
+	defer c.Unlock()
 	return c.lastValidBytes
 }
 
@@ -176,24 +292,88 @@ func (c *Config) Copy() *Config {
 		validateCmd:  c.validateCmd,
 		store:        c.store,
 		cmdRunner:    c.cmdRunner,
+		origin:       c.live(),
 	}
 }
 
+// live returns the config c is a copy of, or c itself if it is not one.
+func (c *Config) live() *Config {
+	if c.origin != nil {
+		return c.origin
+	}
+	return c
+}
+
 func (c *Config) replaceTree(config *Config) {
 	c.tree = config.tree
+	c.deps = config.deps
+}
+
+// Dependencies returns what the current config depends on.
+func (c *Config) Dependencies() Dependencies {
+	c.Lock()
+	defer c.Unlock()
+	return c.deps
 }
 
-func (c *Config) renderAndValidate() ([]byte, error) {
+// watch makes sure the store watches everything in deps to trigger updates,
+// and nothing else that was watched for earlier renders.
+func (c *Config) watch(deps ...Dependencies) {
+	watching := make(map[Dependency]bool)
+	for _, d := range deps {
+		for dep, _ := range d {
+			watching[dep] = true
+			c.watchDependency(dep)
+		}
+	}
+	for dep, _ := range c.watching {
+		if !watching[dep] {
+			c.store.Unwatch(dep)
+		}
+	}
+	c.watching = watching
+}
+
+func (c *Config) watchDependency(dep Dependency) {
+	catalog, isCatalog := c.store.(ServiceCatalog)
+	switch {
+	case dep.Kind == "key":
+		go c.store.WatchToUpdate(c, dep.Name)
+	case dep.Kind == "keys":
+		go c.store.WatchKeysToUpdate(c, dep.Name)
+	case dep.Kind == "services" && isCatalog:
+		go catalog.WatchServicesToUpdate(c)
+	case dep.Kind == "service" && isCatalog:
+		go catalog.WatchServiceToUpdate(c, dep.Name, dep.Tag)
+	}
+	// files are not watched
+}
+
+func (c *Config) renderAndValidate(sandboxed bool) ([]byte, error) {
 	var output bytes.Buffer
-	input := bytes.NewBuffer(c.preprocessor.Process(c.tree).Dump())
+	var tree *JsonTree
+	var calls []*MacroCall
+	var secrets Secrets
+	var err error
+	if sandboxed {
+		tree, err = c.preprocessor.ReportSandboxed(c.tree)
+	} else {
+		tree, calls, secrets, err = c.preprocessor.Render(c.tree)
+	}
+	c.deps = dependenciesOf(calls)
+	if err != nil {
+		return nil, err
+	}
+	input := bytes.NewBuffer(tree.Dump())
 	cmd := execCmd(c.transformCmd)
 	cmd.Stdin = input
 	cmd.Stdout = &output
 	if err := c.cmdRunner(cmd); err != nil {
-		return nil, &ExecError{"transform", err, output.String(), input.String()}
+		redact := secrets.Redact
+		return nil, &ExecError{"transform", err, redact(output.String()), redact(input.String())}
 	}
 	if c.validateCmd != "" {
-		if err := c.execValidate(output.Bytes()); err != nil {
+		if err := c.execValidate(output.Bytes(), secrets); err != nil {
 			return nil, err
 		}
 	}
@@ -201,7 +381,7 @@ func (c *Config) renderAndValidate() ([]byte, error) {
 	return output.Bytes(), nil
 }
 
-func (c *Config) execValidate(configBytes []byte) error {
+func (c *Config) execValidate(configBytes []byte, secrets Secrets) error {
 	var output bytes.Buffer
 	file, err := ioutil.TempFile(os.TempDir(), "configurator-validate.")
 	if err != nil {
@@ -214,7 +394,8 @@ func (c *Config) execValidate(configBytes []byte) error {
 	cmd.Stdout = &output
 	cmd.Stderr = &output
 	if err := c.cmdRunner(cmd); err != nil {
-		return &ExecError{"validation", err, output.String(), string(configBytes)}
+		redact := secrets.Redact
+		return &ExecError{"validation", err, redact(output.String()), redact(string(configBytes))}
 	}
 	os.Remove(file.Name())
 	return nil
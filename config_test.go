@@ -1,7 +1,317 @@
 package main
 
-import "os/exec"
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
 
 func testCmd(e *exec.Cmd) error {
 	return nil
 }
+
+func TestConfigMacroErrorsBlockMutate(t *testing.T) {
+	config, err := NewConfig(NewTestStore(), "", "", "", "")
+	if err != nil {
+		t.Fatalf("failed to make config: %v", err)
+	}
+	config.cmdRunner = testCmd
+
+	err = config.Mutate(func(tree *JsonTree) bool {
+		return tree.Replace("/", map[string]interface{}{
+			"upstream": map[string]interface{}{"$value": "/missing"},
+		})
+	})
+	e, ok := err.(*PreprocessError)
+	if !ok {
+		t.Fatalf("mutate did not fail with macro errors: %v", err)
+	}
+	if len(e.Errors) != 1 || e.Errors[0].Path != "/upstream" {
+		t.Fatalf("macro error was not reported right: %v", e)
+	}
+	if config.Tree().Get("/upstream") != nil {
+		t.Fatalf("failed mutation was applied: %s", config.Dump())
+	}
+}
+
+func TestConfigEval(t *testing.T) {
+	config, err := NewConfig(NewTestStore(), "", "", "", "")
+	if err != nil {
+		t.Fatalf("failed to make config: %v", err)
+	}
+	config.Load([]byte(`{"stored": true}`))
+	config.preprocessor.secretKey = new([32]byte)
+	copy(config.preprocessor.secretKey[:], "configurator-test-key-0123456789")
+
+	value, err := config.Eval(map[string]interface{}{
+		"one":      map[string]interface{}{"$value": "/one"},
+		"auth":     map[string]interface{}{"$join": []interface{}{"user:", map[string]interface{}{"$secret": "/secrets/password"}}},
+		"missing":  map[string]interface{}{"$value": "/missing"},
+		"ref":      map[string]interface{}{"$ref": "#stored"},
+		"password": map[string]interface{}{"$secret": "/secrets/password"},
+		"environ":  map[string]interface{}{"$environ": "PATH"},
+		"env":      map[string]interface{}{"$template": `{{env "PATH"}}`},
+		"env_map":  map[string]interface{}{"$template": `{{.Env.PATH}}`},
+		"file":     map[string]interface{}{"$include": "/etc/hosts", "from": "file"},
+	})
+	expectErrors(t, err, "/env", "/env_map", "/environ", "/file", "/missing", "/ref")
+	if e := err.(*PreprocessError).Errors[2]; e.Err.Error() != "cannot read environment variables here" {
+		t.Fatalf("environment was read: %v", e)
+	}
+	obj := value.(map[string]interface{})
+	if obj["one"] != "1" || obj["auth"] != "[redacted]" || obj["password"] != "[redacted]" {
+		t.Fatalf("fragment did not evaluate right: %#v", obj)
+	}
+	if config.Tree().Get("/stored") != true || config.Tree().Get("/one") != nil {
+		t.Fatalf("fragment was evaluated against the config: %#v %s", obj, config.Dump())
+	}
+}
+
+func TestConfigEvalFileStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "configurator-test.")
+	if err != nil {
+		t.Fatalf("failed to make temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	ioutil.WriteFile(filepath.Join(dir, "config"), []byte("{}"), 0644)
+	ioutil.WriteFile(filepath.Join(dir, "private"), []byte("local only"), 0644)
+	store, err := NewFileStore(&url.URL{Scheme: "file", Path: filepath.Join(dir, "config")})
+	if err != nil {
+		t.Fatalf("failed to make file store: %v", err)
+	}
+	config, err := NewConfig(store, "", "", "", "")
+	if err != nil {
+		t.Fatalf("failed to make config: %v", err)
+	}
+
+	value, err := config.Eval(map[string]interface{}{
+		"value":   map[string]interface{}{"$value": filepath.Join(dir, "private")},
+		"file":    map[string]interface{}{"$file": filepath.Join(dir, "private")},
+		"include": map[string]interface{}{"$include": filepath.Join(dir, "private")},
+		"keys":    map[string]interface{}{"$keys": dir},
+	})
+	expectErrors(t, err, "/file", "/include", "/keys", "/value")
+	if e := err.(*PreprocessError).Errors[0]; e.Err.Error() != "cannot read files here" {
+		t.Fatalf("file was read: %v", e)
+	}
+	if strings.Contains(fmt.Sprint(value), "local only") || strings.Contains(fmt.Sprint(value), "private") {
+		t.Fatalf("local files were read: %#v", value)
+	}
+}
+
+func TestConfigPreprocessed(t *testing.T) {
+	config, err := NewConfig(NewTestStore(), "", "", "", "")
+	if err != nil {
+		t.Fatalf("failed to make config: %v", err)
+	}
+	config.preprocessor.secretKey = new([32]byte)
+	copy(config.preprocessor.secretKey[:], "configurator-test-key-0123456789")
+	config.Load([]byte(`{
+		"http": {
+			"port": {"$value": "/port", "as": "number"},
+			"vhosts": {"$keys": "/vhosts", "values": true},
+			"upstream": {"$join": [{"$value": "/one"}, {"$value": "/two"}], "sep": ","},
+			"auth": {"$secret": "/secrets/password"}
+		},
+		"frontend": {"$include": "/defaults.json"},
+		"missing": {"$value": "/missing"}
+	}`))
+
+	value, calls, err := config.Preprocessed("/http", true)
+	expectErrors(t, err, "/missing")
+	obj := value.(map[string]interface{})
+	if obj["port"] != float64(8080) || obj["upstream"] != "1,2" || obj["auth"] != "[redacted]" {
+		t.Fatalf("config did not preprocess right: %#v", obj)
+	}
+	expected := []string{
+		"/http/auth $secret [/secrets/password]",
+		"/http/port $value [/port]",
+		"/http/upstream $join []",
+		"/http/upstream/$join/0 $value [/one]",
+		"/http/upstream/$join/1 $value [/two]",
+		"/http/vhosts $keys [keys:/vhosts /vhosts/a.example.com /vhosts/b.example.com]",
+	}
+	expectCalls(t, calls, expected)
+
+	_, calls, _ = config.Preprocessed("/frontend", true)
+	expected = []string{
+		"/frontend $include [/defaults.json]",
+		"/frontend/servers $include [/servers.json]",
+		"/frontend/servers/2 $value [/one]",
+		"/frontend/timeout $value [/three]",
+	}
+	expectCalls(t, calls, expected)
+
+	_, calls, _ = config.Preprocessed("/", false)
+	if len(calls) != 0 {
+		t.Fatalf("annotations were recorded without annotate: %#v", calls)
+	}
+	if _, isMacro := config.Tree().Get("/http/port").(map[string]interface{}); !isMacro {
+		t.Fatalf("preprocessing changed the config: %s", config.Dump())
+	}
+}
+
+// expectCalls fails unless calls are described by expected, in order.
+func expectCalls(t *testing.T, calls []*MacroCall, expected []string) {
+	described := make([]string, 0, len(calls))
+	for _, call := range calls {
+		described = append(described, fmt.Sprintf("%s %s %v", call.Path, call.Macro, call.Keys))
+	}
+	if strings.Join(described, "\n") != strings.Join(expected, "\n") {
+		t.Fatalf("macro calls were not recorded right:\n%s", strings.Join(described, "\n"))
+	}
+}
+
+func TestConfigTrace(t *testing.T) {
+	config, err := NewConfig(NewTestStore(), "", "", "", "")
+	if err != nil {
+		t.Fatalf("failed to make config: %v", err)
+	}
+	config.preprocessor.secretKey = new([32]byte)
+	copy(config.preprocessor.secretKey[:], "configurator-test-key-0123456789")
+	config.Load([]byte(`{
+		"upstream": {
+			"host": {"$value": "/missing", "default": {"$value": "/one"}},
+			"port": {"$value": "/port", "as": "number"},
+			"auth": {"$join": ["user", {"$secret": "/secrets/password"}], "sep": ":"},
+			"backup": {"$if": false, "then": "backup"},
+			"broken": {"$value": "/unavailable"}
+		}
+	}`))
+
+	_, calls, err := config.Trace("/upstream")
+	expectErrors(t, err, "/upstream/broken")
+	expectCalls(t, calls, []string{
+		"/upstream/auth $join []",
+		"/upstream/auth/$join/1 $secret [/secrets/password]",
+		"/upstream/backup $if []",
+		"/upstream/broken $value [/unavailable]",
+		"/upstream/host $value [/missing]",
+		"/upstream/host/default $value [/one]",
+		"/upstream/port $value [/port]",
+	})
+
+	auth, secret, backup, broken, host, port := calls[0], calls[1], calls[2], calls[3], calls[4], calls[6]
+	if auth.Value != "[redacted]" || auth.Input.(map[string]interface{})["$join"].([]interface{})[1] != "[redacted]" {
+		t.Fatalf("secret was not redacted from trace: %#v", auth)
+	}
+	if secret.Value != "[redacted]" {
+		t.Fatalf("secret was not redacted from trace: %#v", secret)
+	}
+	if !backup.Omitted || backup.Value != nil {
+		t.Fatalf("omitted value was not traced right: %#v", backup)
+	}
+	if broken.Error != "store unavailable" || broken.Value != nil {
+		t.Fatalf("error was not traced right: %#v", broken)
+	}
+	if !host.Default || host.Value != "1" || host.Input.(map[string]interface{})["$value"] != "/missing" {
+		t.Fatalf("default was not traced right: %#v", host)
+	}
+	if port.Default || port.Value != float64(8080) || port.Input.(map[string]interface{})["as"] != "number" {
+		t.Fatalf("value was not traced right: %#v", port)
+	}
+
+	_, calls, _ = config.Preprocessed("/upstream", true)
+	if calls[0].Input != nil || calls[0].Value != nil {
+		t.Fatalf("annotations include a trace: %#v", calls[0])
+	}
+}
+
+// watchingStore is a TestStore that records which dependencies are being
+// watched.
+type watchingStore struct {
+	TestStore
+	sync.Mutex
+	watching map[Dependency]bool
+}
+
+func (s *watchingStore) WatchToUpdate(config *Config, key string) {
+	s.Lock()
+	defer s.Unlock()
+	s.watching[Dependency{Kind: "key", Name: key}] = true
+}
+
+func (s *watchingStore) WatchKeysToUpdate(config *Config, prefix string) {
+	s.Lock()
+	defer s.Unlock()
+	s.watching[Dependency{Kind: "keys", Name: prefix}] = true
+}
+
+func (s *watchingStore) Unwatch(dep Dependency) {
+	s.Lock()
+	defer s.Unlock()
+	delete(s.watching, dep)
+}
+
+func (s *watchingStore) watched(dep Dependency) bool {
+	for i := 0; i < 100; i++ {
+		s.Lock()
+		watching := s.watching[dep]
+		s.Unlock()
+		if watching {
+			return true
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	return false
+}
+
+func TestConfigDependencies(t *testing.T) {
+	target, err := ioutil.TempFile("", "configurator-test.")
+	if err != nil {
+		t.Fatalf("failed to make target file: %v", err)
+	}
+	target.Close()
+	defer os.Remove(target.Name())
+	store := &watchingStore{watching: make(map[Dependency]bool)}
+	config, err := NewConfig(store, target.Name(), "cat", "", "")
+	if err != nil {
+		t.Fatalf("failed to make config: %v", err)
+	}
+
+	err = config.Mutate(func(tree *JsonTree) bool {
+		return tree.Replace("/", map[string]interface{}{
+			"port":   map[string]interface{}{"$value": "/port", "as": "number"},
+			"vhosts": map[string]interface{}{"$keys": "/vhosts"},
+			"copy":   map[string]interface{}{"$value": "/port"},
+		})
+	})
+	if err != nil {
+		t.Fatalf("failed to mutate config: %v", err)
+	}
+	deps := config.Dependencies()
+	port, vhosts := Dependency{Kind: "key", Name: "/port"}, Dependency{Kind: "keys", Name: "/vhosts"}
+	if len(deps) != 2 || strings.Join(deps[port], ",") != "/copy,/port" || strings.Join(deps[vhosts], ",") != "/vhosts" {
+		t.Fatalf("dependencies were not recorded right: %#v", deps)
+	}
+	if !store.watched(port) || !store.watched(vhosts) {
+		t.Fatalf("dependencies were not watched: %#v", store.watching)
+	}
+	listed := `[{"kind":"key","name":"/port","paths":["/copy","/port"]},{"kind":"keys","name":"/vhosts","paths":["/vhosts"]}]`
+	if data, err := json.Marshal(deps); err != nil || string(data) != listed {
+		t.Fatalf("dependencies were not listed right: %s %v", data, err)
+	}
+
+	err = config.Mutate(func(tree *JsonTree) bool {
+		return tree.Delete("/vhosts")
+	})
+	if err != nil {
+		t.Fatalf("failed to mutate config: %v", err)
+	}
+	if deps := config.Dependencies(); len(deps) != 1 || deps[vhosts] != nil {
+		t.Fatalf("removed dependency was kept: %#v", deps)
+	}
+	store.Lock()
+	defer store.Unlock()
+	if store.watching[vhosts] {
+		t.Fatalf("removed dependency was still watched: %#v", store.watching)
+	}
+}
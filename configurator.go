@@ -17,6 +17,9 @@ var port = flag.String("p", "9000", "port to listen on")
 var checkCmd = flag.String("c", "", "config check command. FILE set in env")
 var reloadCmd = flag.String("r", "", "reload command")
 var showVersion = flag.Bool("v", false, "prints current configurator version")
+var keyFile = flag.String("k", "", "secret key file used to decrypt $secret values")
+var encrypt = flag.Bool("e", false, "encrypts stdin with the -k key file for storing as a $secret")
+var explain = flag.String("x", "", "prints a trace of the macros at or below a path in the stored config and exits")
 
 func assert(err error) {
 	if err != nil {
@@ -57,6 +60,23 @@ func main() {
 		fmt.Println(Version)
 		os.Exit(0)
 	}
+	var key *[32]byte
+	if *keyFile != "" {
+		var err error
+		key, err = loadSecretKey(*keyFile)
+		assert(err)
+	}
+	if *encrypt {
+		if key == nil {
+			log.Fatal("Encrypting requires a secret key file with -k")
+		}
+		plaintext, err := ioutil.ReadAll(os.Stdin)
+		assert(err)
+		ciphertext, err := encryptSecret(key, plaintext)
+		assert(err)
+		fmt.Println(ciphertext)
+		os.Exit(0)
+	}
 	if flag.NArg() < 3 {
 		flag.Usage()
 		os.Exit(64)
@@ -80,6 +100,13 @@ func main() {
 
 	config, err := NewConfig(store, target, transformer, *reloadCmd, *checkCmd)
 	assert(err)
+	config.preprocessor.secretKey = key
+
+	if *explain != "" {
+		assert(store.Pull(config))
+		os.Stdout.Write(append(marshal(traceResponse(config.Trace(*explain))), '\n'))
+		os.Exit(0)
+	}
 
 	log.Printf("Pulling and validating from %s...\n", flag.Arg(0))
 	err = config.Update()
@@ -88,6 +115,10 @@ func main() {
 		fmt.Printf("!! Output of '%s':\n", *checkCmd)
 		fmt.Println(e.Output)
 		os.Exit(3)
+	} else if e, ok := err.(*PreprocessError); ok {
+		fmt.Printf("!! Initial pull from config store resulted in macro errors:\n")
+		fmt.Println(e.Error())
+		os.Exit(3)
 	} else {
 		assert(err)
 	}
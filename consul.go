@@ -4,6 +4,7 @@ import (
 	"errors"
 	"log"
 	"net/url"
+	"strings"
 	"sync"
 	"time"
 
@@ -15,7 +16,7 @@ type ConsulStore struct {
 	client      *consulapi.Client
 	prefix      string
 	configIndex uint64
-	watching    map[string]struct{}
+	watching    map[Dependency]chan struct{}
 }
 
 func NewConsulStore(uri *url.URL) (ConfigStore, error) {
@@ -30,54 +31,188 @@ func NewConsulStore(uri *url.URL) (ConfigStore, error) {
 	return &ConsulStore{
 		client:   client,
 		prefix:   uri.Path[1:],
-		watching: make(map[string]struct{}),
+		watching: make(map[Dependency]chan struct{}),
 	}, nil
 }
 
-func (s *ConsulStore) Get(key string) string {
+func (s *ConsulStore) Get(key string) (string, error) {
 	s.Lock()
 	defer s.Unlock()
 	pair, _, err := s.client.KV().Get(key, nil)
 	if err != nil {
-		log.Println("consul:", err)
+		return "", err
 	}
 	if pair != nil {
-		return string(pair.Value)
+		return string(pair.Value), nil
 	}
-	return ""
+	return "", nil
+}
+
+func (s *ConsulStore) GetPrefix(prefix string) (map[string]string, error) {
+	s.Lock()
+	defer s.Unlock()
+	pairs, _, err := s.client.KV().List(keysPrefix(prefix), nil)
+	if err != nil {
+		return nil, err
+	}
+	values := make(map[string]string, len(pairs))
+	for _, pair := range pairs {
+		values[pair.Key] = string(pair.Value)
+	}
+	return values, nil
+}
+
+func (s *ConsulStore) Keys(prefix string) ([]string, error) {
+	prefix = keysPrefix(prefix)
+	keys, _, err := s.client.KV().Keys(prefix, "/", nil)
+	if err != nil {
+		return nil, err
+	}
+	children := make([]string, 0, len(keys))
+	for _, key := range keys {
+		if key != prefix {
+			children = append(children, strings.TrimSuffix(key, "/"))
+		}
+	}
+	return children, nil
 }
 
 func (s *ConsulStore) WatchToUpdate(config *Config, key string) {
+	s.watchKey(config, Dependency{Kind: "key", Name: key}, key)
+}
+
+// watchKey watches key as dep, which is its own kind for the key of the
+// config itself so it is not stopped along with the keys macros read.
+func (s *ConsulStore) watchKey(config *Config, dep Dependency, key string) {
+	s.watch(config, dep, func(index uint64) (uint64, error) {
+		pair, _, err := s.client.KV().Get(key, waitOptions(index))
+		if err != nil {
+			return 0, err
+		}
+		if pair == nil {
+			return 0, errors.New("key does not exist, so cannot watch " + key)
+		}
+		return pair.ModifyIndex, nil
+	})
+}
+
+func (s *ConsulStore) WatchKeysToUpdate(config *Config, prefix string) {
+	s.watch(config, Dependency{Kind: "keys", Name: prefix}, func(index uint64) (uint64, error) {
+		_, meta, err := s.client.KV().Keys(keysPrefix(prefix), "/", waitOptions(index))
+		if err != nil {
+			return 0, err
+		}
+		return meta.LastIndex, nil
+	})
+}
+
+// keysPrefix makes sure prefix only matches keys inside it, treating it
+// like a directory. The empty prefix lists the top level.
+func keysPrefix(prefix string) string {
+	if prefix == "" || strings.HasSuffix(prefix, "/") {
+		return prefix
+	}
+	return prefix + "/"
+}
+
+func (s *ConsulStore) Services() (map[string][]string, error) {
+	services, _, err := s.client.Catalog().Services(nil)
+	return services, err
+}
+
+func (s *ConsulStore) Service(name, tag string) ([]*ServiceInstance, error) {
+	entries, _, err := s.client.Health().Service(name, tag, true, nil)
+	if err != nil {
+		return nil, err
+	}
+	instances := make([]*ServiceInstance, 0, len(entries))
+	for _, entry := range entries {
+		instances = append(instances, &ServiceInstance{
+			ID:      entry.Service.ID,
+			Name:    entry.Service.Service,
+			Node:    entry.Node.Node,
+			Address: entry.Node.Address,
+			Port:    entry.Service.Port,
+			Tags:    entry.Service.Tags,
+		})
+	}
+	return instances, nil
+}
+
+func (s *ConsulStore) WatchServicesToUpdate(config *Config) {
+	s.watch(config, Dependency{Kind: "services"}, func(index uint64) (uint64, error) {
+		_, meta, err := s.client.Catalog().Services(waitOptions(index))
+		if err != nil {
+			return 0, err
+		}
+		return meta.LastIndex, nil
+	})
+}
+
+func (s *ConsulStore) WatchServiceToUpdate(config *Config, name, tag string) {
+	s.watch(config, Dependency{Kind: "service", Name: name, Tag: tag}, func(index uint64) (uint64, error) {
+		_, meta, err := s.client.Health().Service(name, tag, true, waitOptions(index))
+		if err != nil {
+			return 0, err
+		}
+		return meta.LastIndex, nil
+	})
+}
+
+// watch runs a blocking query loop, triggering a config update whenever the
+// index returned by query changes, until it fails or is stopped by Unwatch.
+// Only one watch runs per dependency.
+func (s *ConsulStore) watch(config *Config, dep Dependency, query func(index uint64) (uint64, error)) {
 	s.Lock()
-	_, watching := s.watching[key]
+	_, watching := s.watching[dep]
 	if watching {
 		s.Unlock()
 		return
 	}
-	s.watching[key] = struct{}{}
+	stop := make(chan struct{})
+	s.watching[dep] = stop
 	var index uint64
 	s.Unlock()
 	for {
-		pair, _, err := s.client.KV().Get(key, &consulapi.QueryOptions{
-			WaitTime:  time.Duration(10) * time.Minute,
-			WaitIndex: index,
-		})
-		if err != nil {
-			log.Println("consul:", err)
+		newindex, err := query(index)
+		select {
+		case <-stop:
 			return
+		default:
 		}
-		if pair == nil {
-			log.Println("consul: key does not exist, so cannot watch", key)
+		if err != nil {
+			log.Println("consul:", err)
+			s.Lock()
+			if s.watching[dep] == stop {
+				delete(s.watching, dep)
+			}
+			s.Unlock()
 			return
 		}
-		if pair.ModifyIndex == index {
+		if newindex == index {
 			// watch was released after timeout
 			continue
 		}
 		if index != 0 {
-			go config.TriggerUpdate(key)
+			go config.TriggerUpdate(dep.String())
 		}
-		index = pair.ModifyIndex
+		index = newindex
+	}
+}
+
+func (s *ConsulStore) Unwatch(dep Dependency) {
+	s.Lock()
+	defer s.Unlock()
+	if stop, watching := s.watching[dep]; watching {
+		close(stop)
+		delete(s.watching, dep)
+	}
+}
+
+func waitOptions(index uint64) *consulapi.QueryOptions {
+	return &consulapi.QueryOptions{
+		WaitTime:  time.Duration(10) * time.Minute,
+		WaitIndex: index,
 	}
 }
 
@@ -85,7 +220,7 @@ func (s *ConsulStore) Pull(config *Config) error {
 	s.Lock()
 	defer s.Unlock()
 	configPath := s.prefix + "/config"
-	go s.WatchToUpdate(config, configPath) // actually runs on exit due to lock
+	go s.watchKey(config, Dependency{Kind: "config", Name: configPath}, configPath) // actually runs on exit due to lock
 	pair, _, err := s.client.KV().Get(configPath, nil)
 	if err != nil {
 		log.Println("consul: pull:", err)
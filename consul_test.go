@@ -0,0 +1,487 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeConsul serves just enough of the Consul HTTP API for ConsulStore,
+// including blocking queries that return when anything changes.
+type fakeConsul struct {
+	sync.Mutex
+	*httptest.Server
+	index    uint64
+	kv       map[string]string
+	modified map[string]uint64
+	services map[string][]*ServiceInstance
+	watched  map[string]bool
+	changed  chan struct{}
+	done     chan struct{}
+}
+
+func newFakeConsul() *fakeConsul {
+	f := &fakeConsul{
+		index:    1,
+		kv:       make(map[string]string),
+		modified: make(map[string]uint64),
+		services: make(map[string][]*ServiceInstance),
+		watched:  make(map[string]bool),
+		changed:  make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+	f.Server = httptest.NewServer(http.HandlerFunc(f.handle))
+	return f
+}
+
+func (f *fakeConsul) Close() {
+	close(f.done)
+	f.Server.Close()
+}
+
+func (f *fakeConsul) store(t *testing.T, prefix string) *ConsulStore {
+	uri, _ := url.Parse(f.URL)
+	uri.Scheme = "consul"
+	uri.Path = "/" + prefix
+	store, err := NewConsulStore(uri)
+	if err != nil {
+		t.Fatalf("failed to make consul store: %v", err)
+	}
+	return store.(*ConsulStore)
+}
+
+func (f *fakeConsul) update(change func()) {
+	f.Lock()
+	defer f.Unlock()
+	before := make(map[string]string, len(f.kv))
+	for key, value := range f.kv {
+		before[key] = value
+	}
+	change()
+	f.index++
+	for key, value := range f.kv {
+		if old, existed := before[key]; !existed || old != value {
+			f.modified[key] = f.index
+		}
+	}
+	for key, _ := range before {
+		if _, exists := f.kv[key]; !exists {
+			f.modified[key] = f.index
+		}
+	}
+	close(f.changed)
+	f.changed = make(chan struct{})
+}
+
+// indexOf returns the index a request blocks on, which for a single key is
+// the index it was last modified at, like Consul.
+func (f *fakeConsul) indexOf(req *http.Request) uint64 {
+	query := req.URL.Query()
+	_, listing := query["keys"]
+	_, recursing := query["recurse"]
+	if !strings.HasPrefix(req.URL.Path, "/v1/kv/") || listing || recursing {
+		return f.index
+	}
+	return f.keyIndex(strings.TrimPrefix(req.URL.Path, "/v1/kv/"))
+}
+
+func (f *fakeConsul) keyIndex(key string) uint64 {
+	if index, modified := f.modified[key]; modified {
+		return index
+	}
+	return 1
+}
+
+// waitForWatch waits for a blocking query on path, since changes made before
+// a watch starts are not noticed by it.
+func (f *fakeConsul) waitForWatch(t *testing.T, path string) {
+	for i := 0; i < 100; i++ {
+		f.Lock()
+		watched := f.watched[path]
+		f.Unlock()
+		if watched {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("%s was not watched", path)
+}
+
+func (f *fakeConsul) handle(w http.ResponseWriter, req *http.Request) {
+	f.Lock()
+	index, _ := strconv.ParseUint(req.URL.Query().Get("index"), 10, 64)
+	for index >= f.indexOf(req) {
+		changed := f.changed
+		f.watched[req.URL.Path] = true
+		f.Unlock()
+		select {
+		case <-changed:
+		case <-f.done:
+			return
+		}
+		f.Lock()
+	}
+	defer f.Unlock()
+	w.Header().Set("X-Consul-Index", strconv.FormatUint(f.indexOf(req), 10))
+	w.Header().Set("X-Consul-LastContact", "0")
+	switch {
+	case strings.HasPrefix(req.URL.Path, "/v1/kv/"):
+		key := strings.TrimPrefix(req.URL.Path, "/v1/kv/")
+		if _, listing := req.URL.Query()["keys"]; listing {
+			f.listKeys(w, key, req.URL.Query().Get("separator"))
+			return
+		}
+		if _, recursing := req.URL.Query()["recurse"]; recursing {
+			f.listPairs(w, key)
+			return
+		}
+		value, exists := f.kv[key]
+		if !exists {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		json.NewEncoder(w).Encode([]map[string]interface{}{{
+			"Key":         key,
+			"Value":       []byte(value),
+			"ModifyIndex": f.keyIndex(key),
+		}})
+	case req.URL.Path == "/v1/catalog/services":
+		services := make(map[string][]string)
+		for name, _ := range f.services {
+			services[name] = []string{}
+		}
+		json.NewEncoder(w).Encode(services)
+	case strings.HasPrefix(req.URL.Path, "/v1/health/service/"):
+		name := strings.TrimPrefix(req.URL.Path, "/v1/health/service/")
+		tag := req.URL.Query().Get("tag")
+		entries := make([]map[string]interface{}, 0)
+		for _, instance := range f.services[name] {
+			if tag != "" && !containsString(instance.Tags, tag) {
+				continue
+			}
+			entries = append(entries, map[string]interface{}{
+				"Node": map[string]interface{}{
+					"Node":    instance.Node,
+					"Address": instance.Address,
+				},
+				"Service": map[string]interface{}{
+					"ID":      instance.ID,
+					"Service": name,
+					"Tags":    instance.Tags,
+					"Port":    instance.Port,
+				},
+			})
+		}
+		json.NewEncoder(w).Encode(entries)
+	default:
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
+
+func (f *fakeConsul) listKeys(w http.ResponseWriter, prefix, separator string) {
+	seen := make(map[string]bool)
+	keys := make([]string, 0)
+	for key, _ := range f.kv {
+		if !strings.HasPrefix(key, prefix) {
+			continue
+		}
+		if i := strings.Index(key[len(prefix):], separator); separator != "" && i >= 0 {
+			key = key[:len(prefix)+i+1]
+		}
+		if !seen[key] {
+			seen[key] = true
+			keys = append(keys, key)
+		}
+	}
+	if len(keys) == 0 {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	json.NewEncoder(w).Encode(keys)
+}
+
+func (f *fakeConsul) listPairs(w http.ResponseWriter, prefix string) {
+	pairs := make([]map[string]interface{}, 0)
+	for key, value := range f.kv {
+		if strings.HasPrefix(key, prefix) {
+			pairs = append(pairs, map[string]interface{}{
+				"Key":         key,
+				"Value":       []byte(value),
+				"ModifyIndex": f.keyIndex(key),
+			})
+		}
+	}
+	if len(pairs) == 0 {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	json.NewEncoder(w).Encode(pairs)
+}
+
+func containsString(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
+
+func TestConsulServiceMacros(t *testing.T) {
+	consul := newFakeConsul()
+	defer consul.Close()
+	consul.services["web"] = []*ServiceInstance{
+		{ID: "web2", Node: "node2", Address: "10.0.0.2", Port: 8080, Tags: []string{"v2"}},
+		{ID: "web1", Node: "node1", Address: "10.0.0.1", Port: 8080, Tags: []string{"v1"}},
+	}
+	consul.services["db"] = []*ServiceInstance{
+		{ID: "db1", Node: "node1", Address: "10.0.0.1", Port: 5432},
+	}
+
+	p := &Preprocessor{}
+	loadBuiltinMacros(p, consul.store(t, "test"))
+
+	result, err := preprocessJson(t, p, `{
+		"web": {"$service": "web"},
+		"ports": {"$service": "web", ".": "Port"},
+		"tagged": {"$service": "web", "tag": "v2", ".": "Address"},
+		"missing": {"$service": "nope"},
+		"all": {"$services": "*"},
+		"matched": {"$services": "d*"}
+	}`)
+	expectErrors(t, err)
+
+	expected := map[string]interface{}{
+		"/web/0/ID":                   "web1",
+		"/web/0/Address":              "10.0.0.1",
+		"/web/0/Port":                 float64(8080),
+		"/web/0/Tags/0":               "v1",
+		"/web/1/ID":                   "web2",
+		"/ports/0":                    float64(8080),
+		"/tagged/0":                   "10.0.0.2",
+		"/all/0/Name":                 "db",
+		"/all/0/Instances/0/Port":     float64(5432),
+		"/all/1/Name":                 "web",
+		"/all/1/Instances/1/Node":     "node2",
+		"/matched/0/Name":             "db",
+		"/matched/0/Instances/0/Name": "db",
+	}
+	for path, value := range expected {
+		if v := result.Get(path); v != value {
+			t.Fatalf("%s did not preprocess right: %#v", path, v)
+		}
+	}
+	if tagged := result.Get("/tagged").([]interface{}); len(tagged) != 1 {
+		t.Fatalf("tagged was not filtered by tag: %#v", tagged)
+	}
+	if missing := result.Get("/missing").([]interface{}); len(missing) != 0 {
+		t.Fatalf("missing service returned instances: %#v", missing)
+	}
+	if matched := result.Get("/matched").([]interface{}); len(matched) != 1 {
+		t.Fatalf("matched did not filter services: %#v", matched)
+	}
+}
+
+func TestConsulServiceWatch(t *testing.T) {
+	consul := newFakeConsul()
+	defer consul.Close()
+	consul.kv["test/config"] = `{"servers": {"$service": "web", ".": "Address"}}`
+	consul.services["web"] = []*ServiceInstance{
+		{ID: "web1", Node: "node1", Address: "10.0.0.1", Port: 80},
+	}
+
+	config := newTestConsulConfig(t, consul)
+	if err := config.Update(); err != nil {
+		t.Fatalf("failed to update config: %v", err)
+	}
+
+	consul.waitForWatch(t, "/v1/health/service/web")
+	consul.update(func() {
+		consul.services["web"] = append(consul.services["web"],
+			&ServiceInstance{ID: "web2", Node: "node2", Address: "10.0.0.2", Port: 80})
+	})
+
+	waitForRender(t, config, "/servers/1", "10.0.0.2")
+}
+
+func TestConsulKeysWatch(t *testing.T) {
+	consul := newFakeConsul()
+	defer consul.Close()
+	consul.kv["test/config"] = `{"vhosts": {"$keys": "test/vhosts"}}`
+	consul.kv["test/vhosts/a.example.com"] = "server a"
+
+	config := newTestConsulConfig(t, consul)
+	if err := config.Update(); err != nil {
+		t.Fatalf("failed to update config: %v", err)
+	}
+
+	consul.waitForWatch(t, "/v1/kv/test/vhosts/")
+	consul.update(func() {
+		consul.kv["test/vhosts/b.example.com"] = "server b"
+	})
+
+	waitForRender(t, config, "/vhosts/1", "b.example.com")
+}
+
+// newTestConsulConfig returns a config backed by consul under the "test"
+// prefix that renders its preprocessed JSON as is.
+func newTestConsulConfig(t *testing.T, consul *fakeConsul) *Config {
+	target, err := ioutil.TempFile("", "configurator-test.")
+	if err != nil {
+		t.Fatalf("failed to make target file: %v", err)
+	}
+	target.Close()
+	config, err := NewConfig(consul.store(t, "test"), target.Name(), "cat", "", "")
+	if err != nil {
+		t.Fatalf("failed to make config: %v", err)
+	}
+	return config
+}
+
+func waitForRender(t *testing.T, config *Config, path string, value interface{}) {
+	defer os.Remove(config.target)
+	for i := 0; i < 100; i++ {
+		rendered := new(JsonTree)
+		if rendered.Load(config.LastRender()) == nil && rendered.Get(path) == value {
+			return
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	t.Fatalf("config was not re-rendered after change: %s", config.LastRender())
+}
+
+func TestConsulKeys(t *testing.T) {
+	consul := newFakeConsul()
+	defer consul.Close()
+	consul.kv["vhosts/"] = ""
+	consul.kv["vhosts/a.example.com"] = "server a"
+	consul.kv["vhosts/b.example.com"] = "server b"
+	consul.kv["vhosts/old/c.example.com"] = "server c"
+	consul.kv["vhostsfoo"] = "not a child"
+
+	p := &Preprocessor{}
+	loadBuiltinMacros(p, consul.store(t, "test"))
+
+	result, err := preprocessJson(t, p, `{
+		"names": {"$keys": "vhosts"},
+		"vhosts": {"$keys": "vhosts/", "values": true}
+	}`)
+	expectErrors(t, err)
+
+	names := result.Get("/names").([]interface{})
+	if len(names) != 3 || names[0] != "a.example.com" || names[1] != "b.example.com" || names[2] != "old" {
+		t.Fatalf("names did not preprocess right: %#v", names)
+	}
+	if v := result.Get("/vhosts/b.example.com"); v != "server b" {
+		t.Fatalf("vhosts did not preprocess right: %#v", result.Get("/vhosts"))
+	}
+}
+
+func TestConsulIncludeWatch(t *testing.T) {
+	consul := newFakeConsul()
+	defer consul.Close()
+	consul.kv["test/config"] = `{"frontend": {"$include": "test/defaults"}}`
+	consul.kv["test/defaults"] = `{"timeout": 5}`
+
+	config := newTestConsulConfig(t, consul)
+	if err := config.Update(); err != nil {
+		t.Fatalf("failed to update config: %v", err)
+	}
+
+	consul.waitForWatch(t, "/v1/kv/test/defaults")
+	consul.update(func() {
+		consul.kv["test/defaults"] = `{"timeout": 10}`
+	})
+
+	waitForRender(t, config, "/frontend/timeout", float64(10))
+}
+
+func TestConsulUnwatch(t *testing.T) {
+	consul := newFakeConsul()
+	defer consul.Close()
+	consul.kv["test/config"] = `{"a": {"$value": "test/a"}}`
+	consul.kv["test/a"] = "a"
+	consul.kv["test/b"] = "b"
+
+	config := newTestConsulConfig(t, consul)
+	if err := config.Update(); err != nil {
+		t.Fatalf("failed to update config: %v", err)
+	}
+	consul.waitForWatch(t, "/v1/kv/test/config")
+	consul.waitForWatch(t, "/v1/kv/test/a")
+
+	// only the config changes, so it is its watch that updates the config
+	consul.update(func() {
+		consul.kv["test/config"] = `{"b": {"$value": "test/b"}}`
+	})
+	waitForRender(t, config, "/b", "b")
+	consul.waitForWatch(t, "/v1/kv/test/b")
+
+	if deps := config.Dependencies(); len(deps) != 1 || deps[Dependency{Kind: "key", Name: "test/b"}] == nil {
+		t.Fatalf("dependencies were not updated: %#v", deps)
+	}
+	store := config.store.(*ConsulStore)
+	store.Lock()
+	defer store.Unlock()
+	if _, watching := store.watching[Dependency{Kind: "key", Name: "test/a"}]; watching {
+		t.Fatalf("key no longer referenced was still watched: %#v", store.watching)
+	}
+	if _, watching := store.watching[Dependency{Kind: "key", Name: "test/b"}]; !watching {
+		t.Fatalf("referenced key was not watched: %#v", store.watching)
+	}
+}
+
+func TestConsulKeysNamedLikeWatches(t *testing.T) {
+	consul := newFakeConsul()
+	defer consul.Close()
+	consul.kv["test/config"] = `{"a": {"$value": "services"}, "b": {"$value": "service:foo"}, "c": {"$value": "keys:bar"}}`
+	consul.kv["services"] = "a"
+	consul.kv["service:foo"] = "b"
+	consul.kv["keys:bar"] = "c"
+
+	config := newTestConsulConfig(t, consul)
+	if err := config.Update(); err != nil {
+		t.Fatalf("failed to update config: %v", err)
+	}
+	consul.waitForWatch(t, "/v1/kv/services")
+	consul.waitForWatch(t, "/v1/kv/service:foo")
+	consul.waitForWatch(t, "/v1/kv/keys:bar")
+
+	consul.update(func() {
+		consul.kv["service:foo"] = "changed"
+	})
+	waitForRender(t, config, "/b", "changed")
+
+	store := config.store.(*ConsulStore)
+	store.Lock()
+	defer store.Unlock()
+	for dep, _ := range store.watching {
+		if dep.Kind != "key" && dep.Kind != "config" {
+			t.Fatalf("key was watched as something else: %#v", store.watching)
+		}
+	}
+}
+
+func TestConsulGetPrefix(t *testing.T) {
+	consul := newFakeConsul()
+	defer consul.Close()
+	consul.kv["app/a"] = "1"
+	consul.kv["app/nested/b"] = "2"
+	consul.kv["apps/c"] = "3"
+
+	values, err := consul.store(t, "test").GetPrefix("app")
+	if err != nil {
+		t.Fatalf("failed to get prefix: %v", err)
+	}
+	if len(values) != 2 || values["app/a"] != "1" || values["app/nested/b"] != "2" {
+		t.Fatalf("prefix was not fetched right: %#v", values)
+	}
+}
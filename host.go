@@ -0,0 +1,50 @@
+package main
+
+import (
+	"net"
+	"os"
+	"runtime"
+	"time"
+)
+
+// HostInfo provides the facts about the local machine used by host macros
+// like $hostname and $ip, so they can be faked in tests.
+type HostInfo interface {
+	Hostname() (string, error)
+	// Addrs returns the addresses of the named interface, or of all
+	// interfaces if name is empty.
+	Addrs(name string) ([]net.Addr, error)
+	CPUs() int
+	// Memory returns the total physical memory in bytes.
+	Memory() (uint64, error)
+	Now() time.Time
+}
+
+type localHost struct{}
+
+func (localHost) Hostname() (string, error) {
+	return os.Hostname()
+}
+
+func (localHost) Addrs(name string) ([]net.Addr, error) {
+	if name == "" {
+		return net.InterfaceAddrs()
+	}
+	iface, err := net.InterfaceByName(name)
+	if err != nil {
+		return nil, err
+	}
+	return iface.Addrs()
+}
+
+func (localHost) CPUs() int {
+	return runtime.NumCPU()
+}
+
+func (localHost) Memory() (uint64, error) {
+	return totalMemory()
+}
+
+func (localHost) Now() time.Time {
+	return time.Now()
+}
@@ -0,0 +1,21 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"syscall"
+)
+
+func totalMemory() (uint64, error) {
+	value, err := syscall.Sysctl("hw.memsize")
+	if err != nil {
+		return 0, err
+	}
+	// Sysctl returns the raw bytes as a string with the trailing zero
+	// byte trimmed, which may have been part of the number.
+	buf := make([]byte, 8)
+	if copy(buf, value) < 7 {
+		return 0, errors.New("unexpected hw.memsize: " + value)
+	}
+	return binary.LittleEndian.Uint64(buf), nil
+}
@@ -0,0 +1,13 @@
+//go:build !linux && !darwin
+// +build !linux,!darwin
+
+package main
+
+import (
+	"errors"
+	"runtime"
+)
+
+func totalMemory() (uint64, error) {
+	return 0, errors.New("memory size not supported on " + runtime.GOOS)
+}
@@ -9,7 +9,12 @@ import (
 )
 
 func runHttp(config *Config) {
-	http.HandleFunc("/v1/render", func(w http.ResponseWriter, req *http.Request) {
+	log.Fatal(http.ListenAndServe(":"+*port, httpHandler(config)))
+}
+
+func httpHandler(config *Config) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/v1/render", func(w http.ResponseWriter, req *http.Request) {
 		log.Println(req.Method, req.RequestURI)
 		switch req.Method {
 		case "GET":
@@ -28,7 +33,7 @@ func runHttp(config *Config) {
 				io.WriteString(w, "Bad request: "+err.Error())
 				return
 			}
-			err = newconfig.Validate()
+			err = newconfig.ValidateSandboxed()
 			if err != nil {
 				w.WriteHeader(http.StatusBadRequest)
 				if e, ok := err.(*ExecError); ok {
@@ -46,7 +51,7 @@ func runHttp(config *Config) {
 		}
 	})
 
-	http.HandleFunc("/v1/config/", func(w http.ResponseWriter, req *http.Request) {
+	mux.HandleFunc("/v1/config/", func(w http.ResponseWriter, req *http.Request) {
 		log.Println(req.Method, req.RequestURI)
 		path := strings.TrimPrefix(req.RequestURI, "/v1/config")
 		handleMutateError := func(err error) {
@@ -109,6 +114,105 @@ func runHttp(config *Config) {
 			w.WriteHeader(http.StatusMethodNotAllowed)
 		}
 	})
+	mux.HandleFunc("/v1/macros", func(w http.ResponseWriter, req *http.Request) {
+		log.Println(req.Method, req.RequestURI)
+		if req.Method != "GET" {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		w.Header().Add("Content-Type", "application/json")
+		w.Write(append(marshal(config.preprocessor.Macros()), '\n'))
+	})
+
+	mux.HandleFunc("/v1/macros/eval", func(w http.ResponseWriter, req *http.Request) {
+		log.Println(req.Method, req.RequestURI)
+		if req.Method != "POST" {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		var json interface{}
+		if err := unmarshal(req.Body, &json); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			io.WriteString(w, "Bad request: "+err.Error())
+			return
+		}
+		value, err := config.Eval(json)
+		w.Header().Add("Content-Type", "application/json")
+		w.Write(append(marshal(map[string]interface{}{
+			"value":  value,
+			"errors": macroErrors(err),
+		}), '\n'))
+	})
+
+	handlePreprocessed := func(w http.ResponseWriter, req *http.Request) {
+		log.Println(req.Method, req.RequestURI)
+		if req.Method != "GET" {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		path := "/" + strings.Trim(strings.TrimPrefix(req.URL.Path, "/v1/preprocessed"), "/")
+		_, annotate := req.URL.Query()["annotate"]
+		value, calls, err := config.Preprocessed(path, annotate)
+		response := map[string]interface{}{
+			"value":  value,
+			"errors": macroErrors(err),
+		}
+		if annotate {
+			response["annotations"] = calls
+		}
+		w.Header().Add("Content-Type", "application/json")
+		w.Write(append(marshal(response), '\n'))
+	}
+	mux.HandleFunc("/v1/preprocessed", handlePreprocessed)
+	mux.HandleFunc("/v1/preprocessed/", handlePreprocessed)
+
+	handleTrace := func(w http.ResponseWriter, req *http.Request) {
+		log.Println(req.Method, req.RequestURI)
+		if req.Method != "GET" {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		path := "/" + strings.Trim(strings.TrimPrefix(req.URL.Path, "/v1/trace"), "/")
+		w.Header().Add("Content-Type", "application/json")
+		w.Write(append(marshal(traceResponse(config.Trace(path))), '\n'))
+	}
+	mux.HandleFunc("/v1/trace", handleTrace)
+	mux.HandleFunc("/v1/trace/", handleTrace)
+
+	mux.HandleFunc("/v1/dependencies", func(w http.ResponseWriter, req *http.Request) {
+		log.Println(req.Method, req.RequestURI)
+		if req.Method != "GET" {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		w.Header().Add("Content-Type", "application/json")
+		w.Write(append(marshal(config.Dependencies()), '\n'))
+	})
+
 	log.Println("Listening on port " + *port)
-	log.Fatal(http.ListenAndServe(":"+*port, nil))
+	return mux
+}
+
+// macroErrors returns the macro errors in err as JSON values.
+func macroErrors(err error) []interface{} {
+	errs := make([]interface{}, 0)
+	if e, ok := err.(*PreprocessError); ok {
+		for _, macroErr := range e.Errors {
+			errs = append(errs, map[string]interface{}{
+				"path":  macroErr.Path,
+				"macro": macroErr.Macro,
+				"error": macroErr.Err.Error(),
+			})
+		}
+	}
+	return errs
+}
+
+// traceResponse returns what Config.Trace returns as a JSON value.
+func traceResponse(value interface{}, calls []*MacroCall, err error) interface{} {
+	return map[string]interface{}{
+		"value":  value,
+		"errors": macroErrors(err),
+		"trace":  calls,
+	}
 }
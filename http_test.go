@@ -0,0 +1,48 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+)
+
+func postRender(t *testing.T, config *Config, body string) *httptest.ResponseRecorder {
+	req, err := http.NewRequest("POST", "/v1/render", strings.NewReader(body))
+	if err != nil {
+		t.Fatalf("failed to make request: %v", err)
+	}
+	w := httptest.NewRecorder()
+	httpHandler(config).ServeHTTP(w, req)
+	return w
+}
+
+func TestHttpRenderRedacts(t *testing.T) {
+	config, err := NewConfig(NewTestStore(), "", "cat", "", "")
+	if err != nil {
+		t.Fatalf("failed to make config: %v", err)
+	}
+	config.preprocessor.secretKey = new([32]byte)
+	copy(config.preprocessor.secretKey[:], "configurator-test-key-0123456789")
+
+	w := postRender(t, config, `{"pw": {"$secret": "/secrets/password"}, "one": {"$value": "/one"}}`)
+	if w.Code != http.StatusOK || strings.Contains(w.Body.String(), "hunter2") {
+		t.Fatalf("render gave away a secret: %d %s", w.Code, w.Body)
+	}
+	if !strings.Contains(w.Body.String(), `"pw": "[redacted]"`) || !strings.Contains(w.Body.String(), `"one": "1"`) {
+		t.Fatalf("render was not redacted right: %s", w.Body)
+	}
+
+	os.Setenv("CONFIGURATOR_TEST_ENV", "from the environment")
+	defer os.Unsetenv("CONFIGURATOR_TEST_ENV")
+	file := writeTempFile(t, "from a file")
+	defer os.Remove(file)
+	w = postRender(t, config, `{"env": {"$environ": "CONFIGURATOR_TEST_ENV"}, "f": {"$include": "`+file+`", "from": "file"}}`)
+	if w.Code != http.StatusBadRequest || strings.Contains(w.Body.String(), "from the") {
+		t.Fatalf("render read the environment or a local file: %d %s", w.Code, w.Body)
+	}
+	if config.LastRender() != nil {
+		t.Fatalf("posted render replaced the last render: %s", config.LastRender())
+	}
+}
@@ -47,7 +47,7 @@ func (t *JsonTree) Get(path string) interface{} {
 			if err != nil {
 				return nil
 			}
-			if i >= len(selection.([]interface{})) {
+			if i < 0 || i >= len(selection.([]interface{})) {
 				return nil
 			}
 			selection = selection.([]interface{})[i]
@@ -81,7 +81,7 @@ func (t *JsonTree) setter(path string) func(obj interface{}) bool {
 			if err != nil {
 				return false
 			}
-			if i >= len(p) {
+			if i < 0 || i >= len(p) {
 				return false
 			}
 			p[i] = obj
@@ -163,7 +163,7 @@ func (t *JsonTree) Delete(path string) bool {
 		if err != nil {
 			return false
 		}
-		if i >= len(parent) {
+		if i < 0 || i >= len(parent) {
 			return false
 		}
 		return t.setter(parentPath)(append(parent[:i], parent[i+1:]...))
@@ -0,0 +1,200 @@
+package main
+
+// MacroDoc describes a macro and the arguments it takes, with the macro's
+// own key being the first argument.
+type MacroDoc struct {
+	Name        string     `json:"name"`
+	Description string     `json:"description"`
+	Args        []MacroArg `json:"args"`
+}
+
+type MacroArg struct {
+	Name        string `json:"name"`
+	Type        string `json:"type"`
+	Required    bool   `json:"required"`
+	Description string `json:"description"`
+}
+
+// defaultArg is taken by every macro, see Preprocessor.call.
+var defaultArg = MacroArg{"default", "any", false, "used in place of the value if the macro finds nothing"}
+
+var builtinMacroDocs = []MacroDoc{
+	{"$value", "Value of a key in the config store.", []MacroArg{
+		{"$value", "string", true, "store key"},
+		{"as", "string", false, "decode as json, number, bool, lines or yaml"},
+	}},
+	{"$file", "Value of a key in the config store, like $value.", []MacroArg{
+		{"$file", "string", true, "store key"},
+		{"as", "string", false, "decode as json, number, bool, lines or yaml"},
+	}},
+	{"$environ", "Value of an environment variable.", []MacroArg{
+		{"$environ", "string", true, "variable name"},
+		{"as", "string", false, "decode as json, number, bool, lines or yaml"},
+	}},
+	{"$include", "JSON document from the store or disk, preprocessed in place.", []MacroArg{
+		{"$include", "string", true, "store key or file path"},
+		{"from", "string", false, "store (the default) or file"},
+	}},
+	{"$secret", "Value of a key in the config store decrypted with the secret key.", []MacroArg{
+		{"$secret", "string", true, "store key"},
+		{"as", "string", false, "decode as json, number, bool, lines or yaml"},
+	}},
+	{"$hostname", "Hostname of this machine.", []MacroArg{
+		{"$hostname", "null", false, ""},
+	}},
+	{"$ip", "First IPv4 address of an interface, or of any non-loopback one.", []MacroArg{
+		{"$ip", "string", false, "interface name"},
+		{"ipv6", "boolean", false, "IPv6 address instead"},
+	}},
+	{"$cpus", "Number of CPUs of this machine.", []MacroArg{
+		{"$cpus", "null", false, ""},
+	}},
+	{"$memory", "Total memory of this machine.", []MacroArg{
+		{"$memory", "string", false, "unit, one of b (the default), kb, mb or gb"},
+	}},
+	{"$now", "Current time.", []MacroArg{
+		{"$now", "string", false, "Go time layout, or unix for seconds since the epoch, RFC 3339 by default"},
+		{"utc", "boolean", false, "in UTC rather than local time"},
+	}},
+	{"$ref", "Preprocessed value at another path in the config.", []MacroArg{
+		{"$ref", "string", true, "path starting with #"},
+	}},
+	{"$set", "Binds a variable for its siblings and everything below them.", []MacroArg{
+		{"$set", "array", true, "variable name starting with @ and its value"},
+	}},
+	{"$def", "Declares a snippet for its siblings and everything below them to $call.", []MacroArg{
+		{"$def", "string", true, "name"},
+		{"params", "object or array", false, "parameter names starting with @, mapped to defaults"},
+		{"body", "any", true, "snippet using the parameters as variables"},
+	}},
+	{"$call", "Instantiates a snippet declared with $def.", []MacroArg{
+		{"$call", "string", true, "name"},
+		{"args", "object", false, "parameter names mapped to values"},
+	}},
+	{"$keys", "Keys under a prefix in the config store.", []MacroArg{
+		{"$keys", "string", true, "store prefix"},
+		{"values", "boolean", false, "object of keys to values instead"},
+	}},
+	{"$if", "Value of then or else depending on a condition, omitted if missing.", []MacroArg{
+		{"$if", "any", true, "condition"},
+		{"then", "any", false, "value if the condition is truthy"},
+		{"else", "any", false, "value otherwise"},
+	}},
+	{"$eq", "Whether all values are equal.", []MacroArg{
+		{"$eq", "array", true, "values"},
+	}},
+	{"$ne", "Whether not all values are equal.", []MacroArg{
+		{"$ne", "array", true, "values"},
+	}},
+	{"$and", "Whether all values are truthy, stopping at the first that is not.", []MacroArg{
+		{"$and", "array", true, "values"},
+	}},
+	{"$or", "Whether any value is truthy, stopping at the first that is.", []MacroArg{
+		{"$or", "array", true, "values"},
+	}},
+	{"$not", "Whether a value is falsy.", []MacroArg{
+		{"$not", "any", true, "value"},
+	}},
+	{"$coalesce", "First value that is not null or empty.", []MacroArg{
+		{"$coalesce", "array", true, "values, where missing ones are not errors"},
+	}},
+	{"$for", "Array or object of a loop evaluated for each element of a collection.", []MacroArg{
+		{"$for", "string", true, "variable name starting with @ bound to each element"},
+		{"in", "array or object", true, "collection"},
+		{"loop", "any", true, "value for each element"},
+		{"index", "string", false, "variable name bound to each index or key"},
+		{"key", "any", false, "key for each element, making an object"},
+		{"else", "any", false, "value if the collection is empty"},
+	}},
+	{"$join", "Strings joined together.", []MacroArg{
+		{"$join", "array", true, "strings, numbers or booleans"},
+		{"sep", "string", false, "separator"},
+	}},
+	{"$split", "String split into an array.", []MacroArg{
+		{"$split", "string", true, "string"},
+		{"sep", "string", false, "separator, whitespace by default"},
+	}},
+	{"$format", "String formatted with Go fmt verbs.", []MacroArg{
+		{"$format", "array", true, "format followed by its arguments"},
+	}},
+	{"$replace", "String with all occurrences of old replaced.", []MacroArg{
+		{"$replace", "string", true, "string"},
+		{"old", "string", true, "string to replace"},
+		{"new", "string", false, "replacement"},
+	}},
+	{"$upper", "String in upper case.", []MacroArg{
+		{"$upper", "string", true, "string"},
+	}},
+	{"$lower", "String in lower case.", []MacroArg{
+		{"$lower", "string", true, "string"},
+	}},
+	{"$trim", "String with leading and trailing characters removed.", []MacroArg{
+		{"$trim", "string", true, "string"},
+		{"cutset", "string", false, "characters to remove, whitespace by default"},
+	}},
+	{"$base64", "String encoded as base64.", []MacroArg{
+		{"$base64", "string", true, "string"},
+	}},
+	{"$base64decode", "String decoded from base64.", []MacroArg{
+		{"$base64decode", "string", true, "base64"},
+	}},
+	{"$sha256", "Hex SHA-256 hash of a string.", []MacroArg{
+		{"$sha256", "string", true, "string"},
+	}},
+	{"$md5", "Hex MD5 hash of a string.", []MacroArg{
+		{"$md5", "string", true, "string"},
+	}},
+	{"$urlencode", "String or object encoded for a URL query.", []MacroArg{
+		{"$urlencode", "string or object", true, "string, or object of parameters"},
+	}},
+	{"$json", "Value serialized as a JSON string.", []MacroArg{
+		{"$json", "any", true, "value"},
+	}},
+	{"$merge", "Objects deep merged, later ones winning.", []MacroArg{
+		{"$merge", "array", true, "objects"},
+		{"arrays", "string", false, "replace (the default) or append arrays"},
+	}},
+	{"$concat", "Arrays concatenated.", []MacroArg{
+		{"$concat", "array", true, "arrays"},
+	}},
+	{"$add", "Sum of numbers.", []MacroArg{
+		{"$add", "array", true, "numbers"},
+	}},
+	{"$mul", "Product of numbers.", []MacroArg{
+		{"$mul", "array", true, "numbers"},
+	}},
+	{"$len", "Length of a string, array or object.", []MacroArg{
+		{"$len", "string, array or object", true, "value"},
+	}},
+	{"$min", "Smallest of numbers or strings.", []MacroArg{
+		{"$min", "array", true, "numbers or strings"},
+	}},
+	{"$max", "Largest of numbers or strings.", []MacroArg{
+		{"$max", "array", true, "numbers or strings"},
+	}},
+	{"$sort", "Array stably sorted.", []MacroArg{
+		{"$sort", "array", true, "numbers or strings, or values to sort by"},
+		{"by", "string", false, "path in each value to sort by"},
+		{"reverse", "boolean", false, "sort in descending order"},
+	}},
+	{"$unique", "Array without duplicates, keeping the first of each.", []MacroArg{
+		{"$unique", "array", true, "values"},
+	}},
+	{"$filter", "Array or object of the elements matching a condition.", []MacroArg{
+		{"$filter", "string or array", true, "variable name starting with @ bound to each element, or an array to keep the truthy values of"},
+		{"in", "array or object", false, "collection"},
+		{"if", "any", false, "condition"},
+	}},
+	{"$template", "String rendered from a Go text/template.", []MacroArg{
+		{"$template", "string", true, "template, with funcs ref, value, var and env, and .Env"},
+		{"data", "any", false, "value available as .Data"},
+	}},
+	{"$service", "Healthy instances of a service from the service catalog.", []MacroArg{
+		{"$service", "string", true, "service name"},
+		{"tag", "string", false, "only instances with this tag"},
+		{".", "string", false, "field of each instance instead"},
+	}},
+	{"$services", "Services from the service catalog with their healthy instances.", []MacroArg{
+		{"$services", "string", true, "glob pattern of service names"},
+	}},
+}
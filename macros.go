@@ -1,41 +1,1353 @@
 package main
 
-func loadBuiltinMacros(preprocessor *Preprocessor, store ConfigStore, config *Config) {
-	preprocessor.Register("$value", func(input macroinput) interface{} {
-		path := input["$value"].(string)
-		go store.WatchToUpdate(config, path)
-		value := store.Get(path)
-		if value != "" {
-			return value
+import (
+	"bytes"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"text/template"
+	"time"
+
+	"gopkg.in/yaml.v2"
+)
+
+// loadBuiltinMacros registers the builtin macros, reading from store. Which
+// keys they read is recorded with each render for Config to watch.
+func loadBuiltinMacros(preprocessor *Preprocessor, store ConfigStore) {
+	for _, doc := range builtinMacroDocs {
+		preprocessor.Describe(doc)
+	}
+
+	preprocessor.Register("$value", func(input macroinput) (interface{}, error) {
+		return storeValue(preprocessor, store, input, "$value")
+	})
+
+	preprocessor.Register("$file", func(input macroinput) (interface{}, error) {
+		return storeValue(preprocessor, store, input, "$file")
+	})
+
+	preprocessor.Register("$environ", func(input macroinput) (interface{}, error) {
+		name, err := input.String("$environ")
+		if err != nil {
+			return nil, err
+		}
+		as, err := input.OptionalString("as")
+		if err != nil {
+			return nil, err
+		}
+		if err := preprocessor.sandbox("environment variables"); err != nil {
+			return nil, err
+		}
+		value := os.Getenv(name)
+		if value == "" {
+			return nil, missing("environment variable not set: " + name)
+		}
+		return decode(value, as)
+	})
+
+	preprocessor.Register("$include", func(input macroinput) (interface{}, error) {
+		key, err := input.String("$include")
+		if err != nil {
+			return nil, err
+		}
+		from, err := input.OptionalString("from")
+		if err != nil {
+			return nil, err
+		}
+		var data []byte
+		switch from {
+		case "", "store":
+			value, err := storeGet(preprocessor, store, key)
+			if err != nil {
+				return nil, err
+			}
+			data = []byte(value)
+		case "file":
+			if err := preprocessor.sandbox("files"); err != nil {
+				return nil, err
+			}
+			value, err := preprocessor.lookup(Dependency{Kind: "file", Name: key}, func() (interface{}, error) {
+				return ioutil.ReadFile(key)
+			})
+			if err != nil {
+				return nil, err
+			}
+			data, _ = value.([]byte)
+			key = "file:" + key
+		default:
+			return nil, errors.New("unknown include source: " + from)
+		}
+		if len(data) == 0 {
+			return nil, missing("key not found: " + key)
+		}
+		doc := new(JsonTree)
+		if err := doc.Load(data); err != nil {
+			return nil, fmt.Errorf("failed to parse %s: %v", key, err)
+		}
+		if err := preprocessor.enter(key); err != nil {
+			return nil, err
+		}
+		defer preprocessor.leave()
+		return preprocessor.eval(doc.Get("/")), nil
+	})
+
+	preprocessor.Register("$secret", func(input macroinput) (interface{}, error) {
+		key, err := input.String("$secret")
+		if err != nil {
+			return nil, err
+		}
+		as, err := input.OptionalString("as")
+		if err != nil {
+			return nil, err
+		}
+		if preprocessor.secretKey == nil {
+			return nil, errors.New("no secret key to decrypt " + key + " with")
+		}
+		ciphertext, err := storeGet(preprocessor, store, key)
+		if err != nil {
+			return nil, err
+		}
+		if ciphertext == "" {
+			return nil, missing("key not found: " + key)
+		}
+		plaintext, err := decryptSecret(preprocessor.secretKey, ciphertext)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", key, err)
+		}
+		preprocessor.tainted()
+		preprocessor.conceal(plaintext)
+		return decode(plaintext, as)
+	})
+
+	preprocessor.Register("$hostname", func(input macroinput) (interface{}, error) {
+		return preprocessor.hostInfo().Hostname()
+	})
+
+	preprocessor.Register("$ip", func(input macroinput) (interface{}, error) {
+		name, err := input.OptionalString("$ip")
+		if err != nil {
+			return nil, err
+		}
+		ipv6, err := input.OptionalBool("ipv6")
+		if err != nil {
+			return nil, err
+		}
+		addrs, err := preprocessor.hostInfo().Addrs(name)
+		if err != nil {
+			return nil, err
+		}
+		for _, addr := range addrs {
+			ipnet, ok := addr.(*net.IPNet)
+			if !ok || (name == "" && ipnet.IP.IsLoopback()) {
+				continue
+			}
+			if (ipnet.IP.To4() == nil) == ipv6 {
+				return ipnet.IP.String(), nil
+			}
+		}
+		if name == "" {
+			return nil, errors.New("no non-loopback address found")
+		}
+		return nil, errors.New("no address found for interface " + name)
+	})
+
+	preprocessor.Register("$cpus", func(input macroinput) (interface{}, error) {
+		return float64(preprocessor.hostInfo().CPUs()), nil
+	})
+
+	preprocessor.Register("$memory", func(input macroinput) (interface{}, error) {
+		unit, err := input.OptionalString("$memory")
+		if err != nil {
+			return nil, err
+		}
+		size, ok := map[string]uint64{"": 1, "b": 1, "kb": 1 << 10, "mb": 1 << 20, "gb": 1 << 30}[strings.ToLower(unit)]
+		if !ok {
+			return nil, errors.New("unknown memory unit: " + unit)
+		}
+		total, err := preprocessor.hostInfo().Memory()
+		if err != nil {
+			return nil, err
+		}
+		return float64(total / size), nil
+	})
+
+	preprocessor.Register("$now", func(input macroinput) (interface{}, error) {
+		layout, err := input.OptionalString("$now")
+		if err != nil {
+			return nil, err
+		}
+		utc, err := input.OptionalBool("utc")
+		if err != nil {
+			return nil, err
+		}
+		now := preprocessor.hostInfo().Now()
+		if utc {
+			now = now.UTC()
+		}
+		switch layout {
+		case "":
+			return now.Format(time.RFC3339), nil
+		case "unix":
+			return float64(now.Unix()), nil
+		}
+		return now.Format(layout), nil
+	})
+
+	preprocessor.Register("$ref", func(input macroinput) (interface{}, error) {
+		ref, err := input.String("$ref")
+		if err != nil {
+			return nil, err
+		}
+		if !strings.HasPrefix(ref, "#") {
+			return nil, errors.New("only references within the config starting with # are supported: " + ref)
+		}
+		return preprocessor.evalPath("/" + strings.TrimPrefix(ref[1:], "/"))
+	})
+
+	// args are evaluated one by one, since as a whole an argument like
+	// {"@name": "value"} would read as a variable.
+	preprocessor.RegisterLazy("$call", func(input macroinput) (interface{}, error) {
+		value := preprocessor.evalAt("$call", input["$call"])
+		name, ok := value.(string)
+		if !ok {
+			return nil, argError("$call", "a string", value)
+		}
+		args, ok := input["args"].(map[string]interface{})
+		if !ok && input["args"] != nil {
+			return nil, argError("args", "an object", input["args"])
+		}
+		evaluated := make(map[string]interface{}, len(args))
+		for _, k := range sortedKeys(args) {
+			if value := preprocessor.evalAt("args/"+k, args[k]); value != omit {
+				evaluated[k] = value
+			}
+		}
+		return preprocessor.instantiate(name, evaluated)
+	})
+
+	preprocessor.Register("$keys", func(input macroinput) (interface{}, error) {
+		prefix, err := input.String("$keys")
+		if err != nil {
+			return nil, err
+		}
+		values, err := input.OptionalBool("values")
+		if err != nil {
+			return nil, err
+		}
+		if err := sandboxStore(preprocessor, store); err != nil {
+			return nil, err
+		}
+		listed, err := preprocessor.lookup(Dependency{Kind: "keys", Name: prefix}, func() (interface{}, error) {
+			return store.Keys(prefix)
+		})
+		if err != nil {
+			return nil, err
+		}
+		listedKeys, _ := listed.([]string)
+		keys := append([]string{}, listedKeys...)
+		sort.Strings(keys)
+		if values {
+			prefetch(preprocessor, store, prefix, keys)
+			obj := make(map[string]interface{}, len(keys))
+			for _, key := range keys {
+				value, err := storeGet(preprocessor, store, key)
+				if err != nil {
+					return nil, err
+				}
+				obj[keyName(prefix, key)] = value
+			}
+			return obj, nil
+		}
+		names := make([]interface{}, 0, len(keys))
+		for _, key := range keys {
+			names = append(names, keyName(prefix, key))
+		}
+		return names, nil
+	})
+
+	preprocessor.RegisterLazy("$if", func(input macroinput) (interface{}, error) {
+		branch := "else"
+		if truthy(preprocessor.evalAt("$if", input["$if"])) {
+			branch = "then"
+		}
+		if node, exists := input[branch]; exists {
+			return preprocessor.evalAt(branch, node), nil
+		}
+		return omit, nil
+	})
+
+	preprocessor.Register("$eq", func(input macroinput) (interface{}, error) {
+		args, err := input.Array("$eq")
+		if err != nil {
+			return nil, err
+		}
+		if len(args) < 2 {
+			return nil, errors.New("$eq expects at least two values")
+		}
+		for _, arg := range args[1:] {
+			if !reflect.DeepEqual(args[0], arg) {
+				return false, nil
+			}
+		}
+		return true, nil
+	})
+
+	preprocessor.Register("$ne", func(input macroinput) (interface{}, error) {
+		args, err := input.Array("$ne")
+		if err != nil {
+			return nil, err
+		}
+		if len(args) != 2 {
+			return nil, errors.New("$ne expects two values")
+		}
+		return !reflect.DeepEqual(args[0], args[1]), nil
+	})
+
+	preprocessor.RegisterLazy("$and", func(input macroinput) (interface{}, error) {
+		args, err := input.Array("$and")
+		if err != nil {
+			return nil, err
+		}
+		for i, arg := range args {
+			if !truthy(preprocessor.evalAt("$and/"+strconv.Itoa(i), arg)) {
+				return false, nil
+			}
+		}
+		return true, nil
+	})
+
+	preprocessor.RegisterLazy("$or", func(input macroinput) (interface{}, error) {
+		args, err := input.Array("$or")
+		if err != nil {
+			return nil, err
+		}
+		for i, arg := range args {
+			if truthy(preprocessor.evalAt("$or/"+strconv.Itoa(i), arg)) {
+				return true, nil
+			}
+		}
+		return false, nil
+	})
+
+	preprocessor.Register("$not", func(input macroinput) (interface{}, error) {
+		return !truthy(input["$not"]), nil
+	})
+
+	preprocessor.RegisterLazy("$coalesce", func(input macroinput) (interface{}, error) {
+		args, err := input.Array("$coalesce")
+		if err != nil {
+			return nil, err
+		}
+		for i, arg := range args {
+			value := preprocessor.evalOptional(fmt.Sprintf("$coalesce/%d", i), arg)
+			if !empty(value) {
+				return value, nil
+			}
+		}
+		return nil, nil
+	})
+
+	preprocessor.RegisterLazy("$for", func(input macroinput) (interface{}, error) {
+		name, err := input.String("$for")
+		if err != nil {
+			return nil, err
+		}
+		if !strings.HasPrefix(name, "@") {
+			return nil, errors.New("$for expects a variable name starting with @")
+		}
+		index, err := input.OptionalString("index")
+		if err != nil {
+			return nil, err
+		}
+		key, keyed := input["key"]
+		var results, keys []interface{}
+		var count int
+		iterate := func(i, elem interface{}) {
+			count++
+			vars := map[string]interface{}{name: elem}
+			if index != "" {
+				vars[index] = i
+			}
+			value := preprocessor.evalWith(vars, "loop", input["loop"])
+			if value == omit {
+				return
+			}
+			results = append(results, value)
+			if keyed {
+				keys = append(keys, preprocessor.evalWith(vars, "key", key))
+			}
+		}
+		switch collection := preprocessor.evalAt("in", input["in"]).(type) {
+		case []interface{}:
+			for i, elem := range collection {
+				iterate(float64(i), elem)
+			}
+		case map[string]interface{}:
+			for _, k := range sortedKeys(collection) {
+				iterate(k, collection[k])
+			}
+		case nil:
+		default:
+			return nil, argError("in", "an array or object", collection)
+		}
+		if count == 0 {
+			if otherwise, exists := input["else"]; exists {
+				return preprocessor.evalAt("else", otherwise), nil
+			}
+		}
+		if keyed {
+			obj := make(map[string]interface{}, len(results))
+			for i, k := range keys {
+				name, ok := k.(string)
+				if !ok {
+					return nil, argError("key", "a string", k)
+				}
+				obj[name] = results[i]
+			}
+			return obj, nil
+		}
+		if results == nil {
+			return []interface{}{}, nil
+		}
+		return results, nil
+	})
+
+	preprocessor.Register("$join", func(input macroinput) (interface{}, error) {
+		args, err := input.Array("$join")
+		if err != nil {
+			return nil, err
+		}
+		sep, err := input.OptionalString("sep")
+		if err != nil {
+			return nil, err
+		}
+		strs := make([]string, 0, len(args))
+		for _, arg := range args {
+			str, err := stringify(arg)
+			if err != nil {
+				return nil, err
+			}
+			strs = append(strs, str)
+		}
+		return strings.Join(strs, sep), nil
+	})
+
+	preprocessor.Register("$split", func(input macroinput) (interface{}, error) {
+		str, err := input.String("$split")
+		if err != nil {
+			return nil, err
+		}
+		sep, err := input.OptionalString("sep")
+		if err != nil {
+			return nil, err
+		}
+		var parts []string
+		if sep == "" {
+			parts = strings.Fields(str)
+		} else {
+			parts = strings.Split(str, sep)
+		}
+		values := make([]interface{}, 0, len(parts))
+		for _, part := range parts {
+			values = append(values, part)
+		}
+		return values, nil
+	})
+
+	preprocessor.Register("$format", func(input macroinput) (interface{}, error) {
+		args, err := input.Array("$format")
+		if err != nil {
+			return nil, err
+		}
+		if len(args) == 0 {
+			return nil, errors.New("$format expects a format string")
+		}
+		format, ok := args[0].(string)
+		if !ok {
+			return nil, argError("$format/0", "a string", args[0])
+		}
+		return sprintf(format, args[1:])
+	})
+
+	preprocessor.Register("$replace", func(input macroinput) (interface{}, error) {
+		str, err := input.String("$replace")
+		if err != nil {
+			return nil, err
+		}
+		old, err := input.String("old")
+		if err != nil {
+			return nil, err
+		}
+		replacement, err := input.OptionalString("new")
+		if err != nil {
+			return nil, err
+		}
+		return strings.Replace(str, old, replacement, -1), nil
+	})
+
+	preprocessor.Register("$upper", func(input macroinput) (interface{}, error) {
+		str, err := input.String("$upper")
+		if err != nil {
+			return nil, err
+		}
+		return strings.ToUpper(str), nil
+	})
+
+	preprocessor.Register("$lower", func(input macroinput) (interface{}, error) {
+		str, err := input.String("$lower")
+		if err != nil {
+			return nil, err
+		}
+		return strings.ToLower(str), nil
+	})
+
+	preprocessor.Register("$trim", func(input macroinput) (interface{}, error) {
+		str, err := input.String("$trim")
+		if err != nil {
+			return nil, err
+		}
+		cutset, err := input.OptionalString("cutset")
+		if err != nil {
+			return nil, err
+		}
+		if cutset == "" {
+			return strings.TrimSpace(str), nil
+		}
+		return strings.Trim(str, cutset), nil
+	})
+
+	preprocessor.Register("$base64", func(input macroinput) (interface{}, error) {
+		str, err := input.String("$base64")
+		if err != nil {
+			return nil, err
+		}
+		return base64.StdEncoding.EncodeToString([]byte(str)), nil
+	})
+
+	preprocessor.Register("$base64decode", func(input macroinput) (interface{}, error) {
+		str, err := input.String("$base64decode")
+		if err != nil {
+			return nil, err
+		}
+		decoded, err := base64.StdEncoding.DecodeString(strings.TrimSpace(str))
+		if err != nil {
+			return nil, fmt.Errorf("invalid base64: %v", err)
+		}
+		return string(decoded), nil
+	})
+
+	preprocessor.Register("$sha256", func(input macroinput) (interface{}, error) {
+		str, err := input.String("$sha256")
+		if err != nil {
+			return nil, err
+		}
+		return fmt.Sprintf("%x", sha256.Sum256([]byte(str))), nil
+	})
+
+	preprocessor.Register("$md5", func(input macroinput) (interface{}, error) {
+		str, err := input.String("$md5")
+		if err != nil {
+			return nil, err
+		}
+		return fmt.Sprintf("%x", md5.Sum([]byte(str))), nil
+	})
+
+	preprocessor.Register("$urlencode", func(input macroinput) (interface{}, error) {
+		switch arg := input["$urlencode"].(type) {
+		case string:
+			return url.QueryEscape(arg), nil
+		case map[string]interface{}:
+			values := make(url.Values, len(arg))
+			for k, v := range arg {
+				str, err := stringify(v)
+				if err != nil {
+					return nil, fmt.Errorf("$urlencode/%s %v", k, err)
+				}
+				values.Set(k, str)
+			}
+			return values.Encode(), nil
+		}
+		return nil, argError("$urlencode", "a string or object", input["$urlencode"])
+	})
+
+	preprocessor.Register("$json", func(input macroinput) (interface{}, error) {
+		var out bytes.Buffer
+		encoder := json.NewEncoder(&out)
+		encoder.SetEscapeHTML(false)
+		if err := encoder.Encode(input["$json"]); err != nil {
+			return nil, err
+		}
+		return strings.TrimSuffix(out.String(), "\n"), nil
+	})
+
+	preprocessor.Register("$merge", func(input macroinput) (interface{}, error) {
+		args, err := input.Array("$merge")
+		if err != nil {
+			return nil, err
+		}
+		arrays, err := input.OptionalString("arrays")
+		if err != nil {
+			return nil, err
+		}
+		if arrays != "" && arrays != "append" && arrays != "replace" {
+			return nil, errors.New("arrays expects append or replace, got " + arrays)
+		}
+		merged := make(map[string]interface{})
+		for i, arg := range args {
+			switch obj := arg.(type) {
+			case nil:
+			case map[string]interface{}:
+				merged = deepMerge(merged, obj, arrays == "append")
+			default:
+				return nil, argError(fmt.Sprintf("$merge/%d", i), "an object", arg)
+			}
+		}
+		return merged, nil
+	})
+
+	preprocessor.Register("$concat", func(input macroinput) (interface{}, error) {
+		args, err := input.Array("$concat")
+		if err != nil {
+			return nil, err
+		}
+		concat := &JsonTree{root: []interface{}{}}
+		for _, arg := range args {
+			if arr, ok := arg.([]interface{}); ok {
+				for _, elem := range arr {
+					concat.Append("/", elem)
+				}
+			} else {
+				concat.Append("/", arg)
+			}
+		}
+		return concat.Get("/"), nil
+	})
+
+	preprocessor.Register("$add", func(input macroinput) (interface{}, error) {
+		numbers, err := numberArgs(input, "$add")
+		if err != nil {
+			return nil, err
+		}
+		var sum float64
+		for _, n := range numbers {
+			sum += n
+		}
+		return sum, nil
+	})
+
+	preprocessor.Register("$mul", func(input macroinput) (interface{}, error) {
+		numbers, err := numberArgs(input, "$mul")
+		if err != nil {
+			return nil, err
+		}
+		product := float64(1)
+		for _, n := range numbers {
+			product *= n
+		}
+		return product, nil
+	})
+
+	preprocessor.Register("$len", func(input macroinput) (interface{}, error) {
+		switch v := input["$len"].(type) {
+		case string:
+			return float64(len([]rune(v))), nil
+		case []interface{}:
+			return float64(len(v)), nil
+		case map[string]interface{}:
+			return float64(len(v)), nil
+		}
+		return nil, argError("$len", "a string, array or object", input["$len"])
+	})
+
+	preprocessor.Register("$min", func(input macroinput) (interface{}, error) {
+		return extreme(input, "$min", func(c int) bool { return c < 0 })
+	})
+
+	preprocessor.Register("$max", func(input macroinput) (interface{}, error) {
+		return extreme(input, "$max", func(c int) bool { return c > 0 })
+	})
+
+	preprocessor.Register("$sort", func(input macroinput) (interface{}, error) {
+		args, err := input.Array("$sort")
+		if err != nil {
+			return nil, err
+		}
+		by, err := input.OptionalString("by")
+		if err != nil {
+			return nil, err
+		}
+		reverse, err := input.OptionalBool("reverse")
+		if err != nil {
+			return nil, err
+		}
+		keys := make([]interface{}, len(args))
+		for i, arg := range args {
+			keys[i] = arg
+			if by != "" {
+				keys[i] = (&JsonTree{root: arg}).Get(by)
+			}
+			if i > 0 {
+				if _, err := compare(keys[0], keys[i]); err != nil {
+					return nil, err
+				}
+			}
+		}
+		sorted := make([]interface{}, len(args))
+		order := make([]int, len(args))
+		for i, _ := range order {
+			order[i] = i
+		}
+		sort.SliceStable(order, func(i, j int) bool {
+			c, _ := compare(keys[order[i]], keys[order[j]])
+			if reverse {
+				return c > 0
+			}
+			return c < 0
+		})
+		for i, k := range order {
+			sorted[i] = args[k]
+		}
+		return sorted, nil
+	})
+
+	preprocessor.Register("$unique", func(input macroinput) (interface{}, error) {
+		args, err := input.Array("$unique")
+		if err != nil {
+			return nil, err
+		}
+		seen := make(map[string]bool, len(args))
+		unique := make([]interface{}, 0, len(args))
+		for _, arg := range args {
+			key, err := json.Marshal(arg)
+			if err != nil {
+				return nil, err
+			}
+			if !seen[string(key)] {
+				seen[string(key)] = true
+				unique = append(unique, arg)
+			}
+		}
+		return unique, nil
+	})
+
+	preprocessor.RegisterLazy("$filter", func(input macroinput) (interface{}, error) {
+		if _, isArray := input["$filter"].([]interface{}); isArray {
+			args, _ := preprocessor.evalAt("$filter", input["$filter"]).([]interface{})
+			filtered := make([]interface{}, 0, len(args))
+			for _, arg := range args {
+				if truthy(arg) {
+					filtered = append(filtered, arg)
+				}
+			}
+			return filtered, nil
+		}
+		name, err := input.String("$filter")
+		if err != nil {
+			return nil, argError("$filter", "a variable name or an array", input["$filter"])
+		}
+		if !strings.HasPrefix(name, "@") {
+			return nil, errors.New("$filter expects a variable name starting with @")
+		}
+		keep := func(elem interface{}) bool {
+			vars := map[string]interface{}{name: elem}
+			return truthy(preprocessor.evalWith(vars, "if", input["if"]))
+		}
+		switch collection := preprocessor.evalAt("in", input["in"]).(type) {
+		case []interface{}:
+			filtered := make([]interface{}, 0, len(collection))
+			for _, elem := range collection {
+				if keep(elem) {
+					filtered = append(filtered, elem)
+				}
+			}
+			return filtered, nil
+		case map[string]interface{}:
+			filtered := make(map[string]interface{}, len(collection))
+			for _, k := range sortedKeys(collection) {
+				if keep(collection[k]) {
+					filtered[k] = collection[k]
+				}
+			}
+			return filtered, nil
+		default:
+			return nil, argError("in", "an array or object", collection)
+		}
+	})
+
+	preprocessor.Register("$template", func(input macroinput) (interface{}, error) {
+		text, err := input.String("$template")
+		if err != nil {
+			return nil, err
+		}
+		return renderTemplate(preprocessor, store, text, input["data"])
+	})
+
+	preprocessor.Register("$service", func(input macroinput) (interface{}, error) {
+		catalog, ok := store.(ServiceCatalog)
+		if !ok {
+			return nil, errors.New("not supported by this config store")
+		}
+		name, err := input.String("$service")
+		if err != nil {
+			return nil, err
+		}
+		tag, err := input.OptionalString("tag")
+		if err != nil {
+			return nil, err
+		}
+		field, err := input.OptionalString(".")
+		if err != nil {
+			return nil, err
+		}
+		service, err := preprocessor.lookup(Dependency{Kind: "service", Name: name, Tag: tag}, func() (interface{}, error) {
+			return catalog.Service(name, tag)
+		})
+		if err != nil {
+			return nil, err
+		}
+		found, _ := service.([]*ServiceInstance)
+		instances := serviceInstances(found)
+		if field != "" {
+			for i, instance := range instances {
+				instances[i] = (&JsonTree{root: instance}).Get(field)
+			}
+		}
+		return instances, nil
+	})
+
+	preprocessor.Register("$services", func(input macroinput) (interface{}, error) {
+		catalog, ok := store.(ServiceCatalog)
+		if !ok {
+			return nil, errors.New("not supported by this config store")
+		}
+		pattern, err := input.String("$services")
+		if err != nil {
+			return nil, err
+		}
+		if _, err := filepath.Match(pattern, ""); err != nil {
+			return nil, err
 		}
-		if input["default"] != nil {
-			return input["default"].(string)
+		catalogued, err := preprocessor.lookup(Dependency{Kind: "services"}, func() (interface{}, error) {
+			return catalog.Services()
+		})
+		if err != nil {
+			return nil, err
 		}
-		return ""
+		services, _ := catalogued.(map[string][]string)
+		names := make([]string, 0)
+		for name, _ := range services {
+			if matched, _ := filepath.Match(pattern, name); matched {
+				names = append(names, name)
+			}
+		}
+		sort.Strings(names)
+		results := make([]interface{}, 0, len(names))
+		for _, name := range names {
+			service, err := preprocessor.lookup(Dependency{Kind: "service", Name: name}, func() (interface{}, error) {
+				return catalog.Service(name, "")
+			})
+			if err != nil {
+				return nil, err
+			}
+			found, _ := service.([]*ServiceInstance)
+			results = append(results, map[string]interface{}{
+				"Name":      name,
+				"Tags":      jsonValue(services[name]),
+				"Instances": serviceInstances(found),
+			})
+		}
+		return results, nil
+	})
+}
+
+// storeValue implements $value and $file, which only differ in name.
+func storeValue(preprocessor *Preprocessor, store ConfigStore, input macroinput, name string) (interface{}, error) {
+	key, err := input.String(name)
+	if err != nil {
+		return nil, err
+	}
+	as, err := input.OptionalString("as")
+	if err != nil {
+		return nil, err
+	}
+	value, err := storeGet(preprocessor, store, key)
+	if err != nil {
+		return nil, err
+	}
+	if value == "" {
+		return nil, missing("key not found: " + key)
+	}
+	return decode(value, as)
+}
+
+// renderTemplate executes text as a Go text/template named after the path
+// being evaluated. Its data has the data argument as .Data and the
+// environment as .Env, and funcs ref, value, var and env look up preprocessed
+// parts of the tree, store values, variables and environment variables.
+func renderTemplate(preprocessor *Preprocessor, store ConfigStore, text string, data interface{}) (string, error) {
+	funcs := template.FuncMap{
+		"ref": func(ref string) (interface{}, error) {
+			return preprocessor.evalPath("/" + strings.TrimPrefix(strings.TrimPrefix(ref, "#"), "/"))
+		},
+		"value": func(key string) (string, error) {
+			value, err := storeGet(preprocessor, store, key)
+			if err == nil && value == "" {
+				err = errors.New("key not found: " + key)
+			}
+			return value, err
+		},
+		"var": func(name string) (interface{}, error) {
+			value, bound := preprocessor.lookupVariable(name)
+			if !bound {
+				return nil, errors.New("variable not bound: " + name)
+			}
+			return value, nil
+		},
+		"env": func(name string) (string, error) {
+			if err := preprocessor.sandbox("environment variables"); err != nil {
+				return "", err
+			}
+			return os.Getenv(name), nil
+		},
+	}
+	tmpl, err := template.New(preprocessor.path).Funcs(funcs).Option("missingkey=error").Parse(text)
+	if err != nil {
+		return "", err
+	}
+	env := make(map[string]string)
+	if preprocessor.sandbox("environment variables") == nil {
+		for _, kv := range os.Environ() {
+			if i := strings.Index(kv, "="); i > 0 {
+				env[kv[:i]] = kv[i+1:]
+			}
+		}
+	}
+	var out bytes.Buffer
+	err = tmpl.Execute(&out, map[string]interface{}{"Data": data, "Env": env})
+	if err != nil {
+		return "", err
+	}
+	return out.String(), nil
+}
+
+// storeGet gets key from the store, only once for each render. If the store
+// can get a whole prefix at once, the directory of key is prefetched when the
+// tree refers to other keys in it, saving a request for each of them.
+func storeGet(preprocessor *Preprocessor, store ConfigStore, key string) (string, error) {
+	if err := sandboxStore(preprocessor, store); err != nil {
+		return "", err
+	}
+	planned, _ := preprocessor.memoize(Dependency{Kind: "prefetch"}, func() (interface{}, error) {
+		dirs := make(map[string][]string)
+		for _, k := range staticKeys(preprocessor.tree.Get("/"), nil) {
+			dirs[path.Dir(k)] = append(dirs[path.Dir(k)], k)
+		}
+		return dirs, nil
+	})
+	dirs, _ := planned.(map[string][]string)
+	prefetch(preprocessor, store, path.Dir(key), dirs[path.Dir(key)])
+	value, err := preprocessor.lookup(Dependency{Kind: "key", Name: key}, func() (interface{}, error) {
+		return store.Get(key)
 	})
+	text, _ := value.(string)
+	return text, err
+}
 
-	preprocessor.Register("$file", func(input macroinput) interface{} {
-		path := input["$file"].(string)
-		go store.WatchToUpdate(config, path)
-		value := store.Get(path)
-		if value != "" {
-			return value
+// sandboxStore fails while sandboxed if store reads local files, as keys of
+// a FileStore are paths to any file.
+func sandboxStore(preprocessor *Preprocessor, store ConfigStore) error {
+	if _, isFile := store.(*FileStore); isFile {
+		return preprocessor.sandbox("files")
+	}
+	return nil
+}
+
+// prefetch gets all the values under prefix at once if there is more than
+// one of keys to get and the store supports it.
+func prefetch(preprocessor *Preprocessor, store ConfigStore, prefix string, keys []string) {
+	fetcher, ok := store.(PrefixFetcher)
+	if !ok || len(keys) < 2 || prefix == "." || prefix == "/" {
+		return
+	}
+	preprocessor.memoize(Dependency{Kind: "prefix", Name: prefix}, func() (interface{}, error) {
+		values, err := fetcher.GetPrefix(prefix)
+		if err != nil {
+			log.Println("prefetch:", err)
+			return nil, err
+		}
+		for _, key := range keys {
+			preprocessor.remember(Dependency{Kind: "key", Name: key}, values[key])
 		}
-		if input["default"] != nil {
-			return input["default"].(string)
+		for key, value := range values {
+			preprocessor.remember(Dependency{Kind: "key", Name: key}, value)
 		}
-		return ""
+		return nil, nil
 	})
+}
+
+// staticKeys appends the store keys given literally to macros in node.
+func staticKeys(node interface{}, keys []string) []string {
+	switch n := node.(type) {
+	case map[string]interface{}:
+		for _, name := range []string{"$value", "$file", "$secret", "$include"} {
+			key, ok := n[name].(string)
+			if ok && (name != "$include" || n["from"] == nil || n["from"] == "store") {
+				keys = append(keys, key)
+			}
+		}
+		for _, k := range sortedKeys(n) {
+			keys = staticKeys(n[k], keys)
+		}
+	case []interface{}:
+		for _, v := range n {
+			keys = staticKeys(v, keys)
+		}
+	}
+	return keys
+}
+
+// numberArgs returns the array argument key, which must only hold numbers.
+func numberArgs(input macroinput, key string) ([]float64, error) {
+	args, err := input.Array(key)
+	if err != nil {
+		return nil, err
+	}
+	numbers := make([]float64, len(args))
+	for i, arg := range args {
+		n, ok := arg.(float64)
+		if !ok {
+			return nil, argError(fmt.Sprintf("%s/%d", key, i), "a number", arg)
+		}
+		numbers[i] = n
+	}
+	return numbers, nil
+}
+
+// compare orders two numbers or two strings, erroring on anything else.
+func compare(a, b interface{}) (int, error) {
+	switch a := a.(type) {
+	case float64:
+		if b, ok := b.(float64); ok {
+			switch {
+			case a < b:
+				return -1, nil
+			case a > b:
+				return 1, nil
+			}
+			return 0, nil
+		}
+	case string:
+		if b, ok := b.(string); ok {
+			return strings.Compare(a, b), nil
+		}
+	default:
+		return 0, fmt.Errorf("can only compare numbers or strings, got %s", jsonType(a))
+	}
+	return 0, fmt.Errorf("cannot compare %s with %s", jsonType(a), jsonType(b))
+}
 
-	// $keys
-	// $file
-	// $environ
+// extreme implements $min and $max, returning the value for which wins
+// returns true when it is compared to every other.
+func extreme(input macroinput, key string, wins func(int) bool) (interface{}, error) {
+	args, err := input.Array(key)
+	if err != nil {
+		return nil, err
+	}
+	if len(args) == 0 {
+		return nil, errors.New(key + " expects at least one value")
+	}
+	result := args[0]
+	for _, arg := range args {
+		c, err := compare(arg, result)
+		if err != nil {
+			return nil, err
+		}
+		if wins(c) {
+			result = arg
+		}
+	}
+	return result, nil
+}
 
-	// $for
-	// $if
-	// $eq
-	// $ne
+// deepMerge returns dst with src merged in like JsonTree.Merge, except
+// objects in both are merged in turn, and arrays in both are appended if
+// appendArrays is set. Neither dst nor src are modified.
+func deepMerge(dst, src map[string]interface{}, appendArrays bool) map[string]interface{} {
+	merged := make(map[string]interface{}, len(dst)+len(src))
+	for k, v := range dst {
+		merged[k] = v
+	}
+	for k, v := range src {
+		switch v := v.(type) {
+		case map[string]interface{}:
+			if obj, ok := merged[k].(map[string]interface{}); ok {
+				merged[k] = deepMerge(obj, v, appendArrays)
+				continue
+			}
+		case []interface{}:
+			if arr, ok := merged[k].([]interface{}); ok && appendArrays {
+				merged[k] = append(append([]interface{}{}, arr...), v...)
+				continue
+			}
+		}
+		merged[k] = v
+	}
+	return merged
+}
+
+// stringify formats a scalar JSON value the way it would appear in a
+// config file, so numbers have no exponent or trailing zeros.
+func stringify(value interface{}) (string, error) {
+	switch v := value.(type) {
+	case nil:
+		return "", nil
+	case string:
+		return v, nil
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64), nil
+	case bool:
+		return strconv.FormatBool(v), nil
+	}
+	return "", fmt.Errorf("expects strings, numbers or booleans, got %s", jsonType(value))
+}
+
+// sprintf is fmt.Sprintf for JSON values. Since JSON only has float64
+// numbers, whole numbers are passed as integers to integer verbs like %d,
+// while numbers and booleans are formatted as they would appear in a config
+// file for %s, %q and %v. Values a verb cannot format are an error rather
+// than ending up in the output as %!d(string=...).
+func sprintf(format string, args []interface{}) (string, error) {
+	directives, err := formatDirectives(format)
+	if err != nil {
+		return "", err
+	}
+	if len(directives) != len(args) {
+		return "", fmt.Errorf("format has %d verbs but %d values were given", len(directives), len(args))
+	}
+	values := make([]interface{}, len(args))
+	for i, arg := range args {
+		verb := rune(directives[i][len(directives[i])-1])
+		values[i] = arg
+		switch v := arg.(type) {
+		case float64:
+			if strings.ContainsRune("bcdoOxXU", verb) && v == float64(int64(v)) {
+				values[i] = int64(v)
+			} else if strings.ContainsRune("sqv", verb) {
+				values[i] = strconv.FormatFloat(v, 'f', -1, 64)
+			}
+		case bool:
+			if strings.ContainsRune("sqv", verb) {
+				values[i] = strconv.FormatBool(v)
+			}
+		case string:
+		default:
+			return "", argError(fmt.Sprintf("$format/%d", i+1), "a string, number or boolean", arg)
+		}
+		if out := fmt.Sprintf(directives[i], values[i]); strings.HasPrefix(out, "%!") {
+			return "", fmt.Errorf("$format/%d: %s cannot format %s", i+1, directives[i], jsonType(arg))
+		}
+	}
+	return fmt.Sprintf(format, values...), nil
+}
+
+// formatDirectives returns each directive in format, such as %-5d, in
+// order. Argument indexes and * widths are not supported, as they would
+// not line up with the values given.
+func formatDirectives(format string) ([]string, error) {
+	var directives []string
+	for i := 0; i < len(format); i++ {
+		if format[i] != '%' {
+			continue
+		}
+		start := i
+		i++
+		for i < len(format) && strings.IndexByte("+-# 0123456789.", format[i]) >= 0 {
+			i++
+		}
+		if i == len(format) {
+			return nil, errors.New("format ends in an incomplete verb")
+		}
+		if format[i] == '[' || format[i] == '*' {
+			return nil, errors.New("format argument indexes and * widths are not supported")
+		}
+		if format[i] != '%' {
+			directives = append(directives, format[start:i+1])
+		}
+	}
+	return directives, nil
+}
+
+// keyName returns the name of key relative to the prefix it was listed under.
+func keyName(prefix, key string) string {
+	return strings.TrimPrefix(strings.TrimPrefix(key, prefix), "/")
+}
+
+// serviceInstances converts instances to plain JSON values, sorted so
+// renders stay stable regardless of the order the catalog returns them in.
+func serviceInstances(instances []*ServiceInstance) []interface{} {
+	sort.Sort(byNodeAndID(instances))
+	values := make([]interface{}, 0, len(instances))
+	for _, instance := range instances {
+		values = append(values, jsonValue(instance))
+	}
+	return values
+}
+
+type byNodeAndID []*ServiceInstance
+
+func (s byNodeAndID) Len() int      { return len(s) }
+func (s byNodeAndID) Swap(i, j int) { s[i], s[j] = s[j], s[i] }
+func (s byNodeAndID) Less(i, j int) bool {
+	if s[i].Node != s[j].Node {
+		return s[i].Node < s[j].Node
+	}
+	return s[i].ID < s[j].ID
+}
+
+// jsonValue converts a Go value into its generic JSON representation, the
+// same kind of value JsonTree holds.
+func jsonValue(obj interface{}) interface{} {
+	var value interface{}
+	bytes, err := json.Marshal(obj)
+	if err != nil {
+		log.Println("macros:", err)
+		return nil
+	}
+	if err := json.Unmarshal(bytes, &value); err != nil {
+		log.Println("macros:", err)
+		return nil
+	}
+	return value
+}
+
+// empty reports whether value is null, or an empty string, array or object.
+func empty(value interface{}) bool {
+	switch v := value.(type) {
+	case nil:
+		return true
+	case string:
+		return v == ""
+	case []interface{}:
+		return len(v) == 0
+	case map[string]interface{}:
+		return len(v) == 0
+	}
+	return value == omit
+}
+
+// truthy follows the usual scripting rules: null, false, 0, empty strings
+// and empty arrays or objects are false, everything else is true.
+func truthy(value interface{}) bool {
+	switch v := value.(type) {
+	case nil:
+		return false
+	case bool:
+		return v
+	case float64:
+		return v != 0
+	case string:
+		return v != ""
+	case []interface{}:
+		return len(v) > 0
+	case map[string]interface{}:
+		return len(v) > 0
+	}
+	return value != omit
+}
+
+// decode parses value as the type named by as, one of json, number, bool,
+// lines or yaml. The empty string leaves value as is.
+func decode(value, as string) (interface{}, error) {
+	switch as {
+	case "":
+		return value, nil
+	case "json":
+		var obj interface{}
+		if err := json.Unmarshal([]byte(value), &obj); err != nil {
+			return nil, fmt.Errorf("unable to decode as json: %v", err)
+		}
+		return obj, nil
+	case "number":
+		n, err := strconv.ParseFloat(strings.TrimSpace(value), 64)
+		if err != nil {
+			return nil, fmt.Errorf("unable to decode %q as number", value)
+		}
+		return n, nil
+	case "bool":
+		b, err := strconv.ParseBool(strings.TrimSpace(value))
+		if err != nil {
+			return nil, fmt.Errorf("unable to decode %q as bool", value)
+		}
+		return b, nil
+	case "lines":
+		lines := make([]interface{}, 0)
+		for _, line := range strings.Split(value, "\n") {
+			if line = strings.TrimRight(line, "\r"); line != "" {
+				lines = append(lines, line)
+			}
+		}
+		return lines, nil
+	case "yaml":
+		var obj interface{}
+		if err := yaml.Unmarshal([]byte(value), &obj); err != nil {
+			return nil, fmt.Errorf("unable to decode as yaml: %v", err)
+		}
+		return yamlToJson(obj)
+	}
+	return nil, errors.New("unknown type to decode as: " + as)
+}
+
+// yamlToJson converts what the yaml package decodes to the values JsonTree
+// holds, since YAML allows non-string keys and has separate integers.
+func yamlToJson(value interface{}) (interface{}, error) {
+	switch v := value.(type) {
+	case map[interface{}]interface{}:
+		obj := make(map[string]interface{}, len(v))
+		for key, elem := range v {
+			k, err := stringify(yamlScalar(key))
+			if err != nil {
+				return nil, errors.New("unable to decode as yaml: keys must be scalars")
+			}
+			if obj[k], err = yamlToJson(elem); err != nil {
+				return nil, err
+			}
+		}
+		return obj, nil
+	case []interface{}:
+		arr := make([]interface{}, len(v))
+		for i, elem := range v {
+			var err error
+			if arr[i], err = yamlToJson(elem); err != nil {
+				return nil, err
+			}
+		}
+		return arr, nil
+	}
+	return yamlScalar(value), nil
+}
 
-	// $service
-	// $services
+func yamlScalar(value interface{}) interface{} {
+	switch v := value.(type) {
+	case int:
+		return float64(v)
+	case int64:
+		return float64(v)
+	case uint64:
+		return float64(v)
+	}
+	return value
 }
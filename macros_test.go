@@ -0,0 +1,432 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+type macroTest struct {
+	input    string
+	expected interface{}
+	fails    bool
+}
+
+// testMacros preprocesses the input of each test as a value, comparing it
+// to what is expected or making sure it fails.
+func testMacros(t *testing.T, tests []macroTest) {
+	testMacrosWith(t, newTestPreprocessor(t), tests)
+}
+
+func testMacrosWith(t *testing.T, p *Preprocessor, tests []macroTest) {
+	for _, test := range tests {
+		result, err := preprocessJson(t, p, `{"value": `+test.input+`}`)
+		if test.fails {
+			if err == nil {
+				t.Fatalf("%s did not fail, got: %#v", test.input, result.Get("/value"))
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("%s failed: %v", test.input, err)
+		}
+		if value := result.Get("/value"); !reflect.DeepEqual(value, test.expected) {
+			t.Fatalf("%s did not preprocess right: %#v", test.input, value)
+		}
+	}
+}
+
+func TestStringMacros(t *testing.T) {
+	testMacros(t, []macroTest{
+		{`{"$join": ["a", "b", "c"]}`, "abc", false},
+		{`{"$join": ["server", {"$value": "/one"}, 8080, true], "sep": " "}`, "server 1 8080 true", false},
+		{`{"$join": [], "sep": ","}`, "", false},
+		{`{"$join": [["nested"]]}`, nil, true},
+		{`{"$join": "abc"}`, nil, true},
+		{`{"$split": "a,b,,c", "sep": ","}`, []interface{}{"a", "b", "", "c"}, false},
+		{`{"$split": "  a b\tc\n"}`, []interface{}{"a", "b", "c"}, false},
+		{`{"$split": 3}`, nil, true},
+		{`{"$format": ["server %s:%d", "example.com", 8080]}`, "server example.com:8080", false},
+		{`{"$format": ["%v/%v %.2f %x", {"$value": "/two"}, 1.5, 3, 255]}`, "2/1.5 3.00 ff", false},
+		{`{"$format": ["%d%%", 50]}`, "50%", false},
+		{`{"$format": ["%s and %s", "one"]}`, nil, true},
+		{`{"$format": ["%s", "one", "two"]}`, nil, true},
+		{`{"$format": [3]}`, nil, true},
+		{`{"$format": ["server %s:%s", "example.com", 8080]}`, "server example.com:8080", false},
+		{`{"$format": ["%s %q %v", 1e21, 1.5, true]}`, `1000000000000000000000 "1.5" true`, false},
+		{`{"$format": ["%d", "8080"]}`, nil, true},
+		{`{"$format": ["%d", 1.5]}`, nil, true},
+		{`{"$format": ["%s", null]}`, nil, true},
+		{`{"$format": ["%s", ["a"]]}`, nil, true},
+		{`{"$format": ["%[1]d", 1]}`, nil, true},
+		{`{"$format": ["%*d", 5, 1]}`, nil, true},
+		{`{"$format": ["100%"]}`, nil, true},
+		{`{"$replace": "a.example.com", "old": ".", "new": "_"}`, "a_example_com", false},
+		{`{"$replace": "a.example.com", "old": ".example"}`, "a.com", false},
+		{`{"$replace": "abc"}`, nil, true},
+		{`{"$upper": "get"}`, "GET", false},
+		{`{"$lower": {"$format": ["%s", "X-Forwarded-For"]}}`, "x-forwarded-for", false},
+		{`{"$lower": null}`, nil, true},
+		{`{"$trim": "  spaced \n"}`, "spaced", false},
+		{`{"$trim": "/path/", "cutset": "/"}`, "path", false},
+		{`{"$trim": ["list"]}`, nil, true},
+	})
+}
+
+func TestValueDecoding(t *testing.T) {
+	testMacros(t, []macroTest{
+		{`{"$value": "/port"}`, "8080\n", false},
+		{`{"$value": "/port", "as": "number"}`, float64(8080), false},
+		{`{"$file": "/enabled", "as": "bool"}`, true, false},
+		{`{"$value": "/servers.json", "as": "json"}`, []interface{}{"a", "b", "1"}, false},
+		{`{"$value": "/servers.txt", "as": "lines"}`, []interface{}{"a", "b", "c"}, false},
+		{`{"$value": "/servers.yaml", "as": "yaml"}`, map[string]interface{}{
+			"servers": []interface{}{
+				map[string]interface{}{"host": "a", "port": float64(80)},
+				map[string]interface{}{"host": "b", "weight": 1.5},
+			},
+			"8080": true,
+		}, false},
+		{`{"$value": "/missing", "as": "number", "default": 80}`, float64(80), false},
+		{`{"$value": "/one", "as": "bool"}`, true, false},
+		{`{"$value": "/servers.txt", "as": "number"}`, nil, true},
+		{`{"$value": "/servers.txt", "as": "json"}`, nil, true},
+		{`{"$value": "/enabled", "as": "xml"}`, nil, true},
+	})
+}
+
+func TestCombiningMacros(t *testing.T) {
+	testMacros(t, []macroTest{
+		{`{"$merge": [{"a": 1, "b": {"c": 2, "d": [1]}}, {"b": {"d": [2], "e": 3}}, null]}`,
+			map[string]interface{}{
+				"a": float64(1),
+				"b": map[string]interface{}{"c": float64(2), "d": []interface{}{float64(2)}, "e": float64(3)},
+			}, false},
+		{`{"$merge": [{"d": [1], "x": {"y": 1}}, {"d": [2], "x": "replaced"}], "arrays": "append"}`,
+			map[string]interface{}{"d": []interface{}{float64(1), float64(2)}, "x": "replaced"}, false},
+		{`{"$merge": [{"timeout": {"$value": "/one"}}, {"timeout": {"$value": "/two"}}]}`,
+			map[string]interface{}{"timeout": "2"}, false},
+		{`{"$merge": []}`, map[string]interface{}{}, false},
+		{`{"$merge": [{"a": 1}, [2]]}`, nil, true},
+		{`{"$merge": [{"a": 1}], "arrays": "prepend"}`, nil, true},
+		{`{"$concat": [[1, 2], [], [3, [4]], "five"]}`,
+			[]interface{}{float64(1), float64(2), float64(3), []interface{}{float64(4)}, "five"}, false},
+		{`{"$concat": [{"$value": "/servers.json", "as": "json"}, ["c"]]}`,
+			[]interface{}{"a", "b", "1", "c"}, false},
+		{`{"$concat": []}`, []interface{}{}, false},
+		{`{"$concat": {"a": 1}}`, nil, true},
+	})
+
+	p := newTestPreprocessor(t)
+	result, err := preprocessJson(t, p, `{
+		"_base": {"$set": ["@base", {"listen": 80, "location": {"/": {"proxy_pass": "app"}}}]},
+		"site": {"$merge": [{"@base": null}, {"location": {"/api": {"proxy_pass": "api"}}}]},
+		"base": {"@base": null}
+	}`)
+	expectErrors(t, err)
+	if _, exists := result.Get("/base/location").(map[string]interface{})["/api"]; exists {
+		t.Fatalf("merge modified its input: %#v", result.Get("/base"))
+	}
+	if site := result.Get("/site/location").(map[string]interface{}); len(site) != 2 {
+		t.Fatalf("merge did not merge nested objects: %#v", site)
+	}
+}
+
+func TestArithmeticAndCollectionMacros(t *testing.T) {
+	testMacros(t, []macroTest{
+		{`{"$add": [1, 2, 3.5]}`, 6.5, false},
+		{`{"$add": [{"$value": "/port", "as": "number"}, 1]}`, float64(8081), false},
+		{`{"$add": []}`, float64(0), false},
+		{`{"$add": [1, "2"]}`, nil, true},
+		{`{"$mul": [{"$len": [1, 2, 3, 4]}, 1024]}`, float64(4096), false},
+		{`{"$mul": [2, null]}`, nil, true},
+		{`{"$len": "héllo"}`, float64(5), false},
+		{`{"$len": {"a": 1, "b": 2}}`, float64(2), false},
+		{`{"$len": 3}`, nil, true},
+		{`{"$min": [3, 1, 2]}`, float64(1), false},
+		{`{"$max": ["b", "c", "a"]}`, "c", false},
+		{`{"$max": [1, "a"]}`, nil, true},
+		{`{"$min": []}`, nil, true},
+		{`{"$sort": ["b", "c", "a"]}`, []interface{}{"a", "b", "c"}, false},
+		{`{"$sort": [2, 10, 1], "reverse": true}`, []interface{}{float64(10), float64(2), float64(1)}, false},
+		{`{"$sort": [{"h": "b", "n": 1}, {"h": "a", "n": 2}, {"h": "b", "n": 3}, {"h": "a", "n": 4}], "by": "h"}`,
+			[]interface{}{
+				map[string]interface{}{"h": "a", "n": float64(2)},
+				map[string]interface{}{"h": "a", "n": float64(4)},
+				map[string]interface{}{"h": "b", "n": float64(1)},
+				map[string]interface{}{"h": "b", "n": float64(3)},
+			}, false},
+		{`{"$sort": [1, "a"]}`, nil, true},
+		{`{"$sort": [[1], [2]]}`, nil, true},
+		{`{"$sort": []}`, []interface{}{}, false},
+		{`{"$unique": ["b", "a", "b", 1, 1, {"x": 1}, {"x": 1}]}`,
+			[]interface{}{"b", "a", float64(1), map[string]interface{}{"x": float64(1)}}, false},
+		{`{"$sort": {"$unique": {"$concat": [{"$value": "/servers.txt", "as": "lines"}, ["b", "a"]]}}}`,
+			[]interface{}{"a", "b", "c"}, false},
+		{`{"$filter": ["a", "", null, 0, false, "b"]}`, []interface{}{"a", "b"}, false},
+		{`{"$filter": "@n", "in": [1, 5, 10], "if": {"$eq": [{"$max": [{"@n": null}, 4]}, {"@n": null}]}}`,
+			[]interface{}{float64(5), float64(10)}, false},
+		{`{"$filter": "@v", "in": {"a": "1", "b": "2"}, "if": {"$ne": [{"@v": null}, {"$value": "/one"}]}}`,
+			map[string]interface{}{"b": "2"}, false},
+		{`{"$filter": "@v", "in": "abc", "if": true}`, nil, true},
+		{`{"$filter": 3}`, nil, true},
+	})
+}
+
+func TestEncodingMacros(t *testing.T) {
+	testMacros(t, []macroTest{
+		{`{"$base64": {"$join": ["user", {"$value": "/one"}], "sep": ":"}}`, "dXNlcjox", false},
+		{`{"$base64": ""}`, "", false},
+		{`{"$base64": 3}`, nil, true},
+		{`{"$base64decode": "dXNlcjox\n"}`, "user:1", false},
+		{`{"$base64decode": "not base64!"}`, nil, true},
+		{`{"$sha256": "abc"}`, "ba7816bf8f01cfea414140de5dae2223b00361a396177a9cb410ff61f20015ad", false},
+		{`{"$md5": {"$value": "/servers.txt"}}`, "6e966467157a0f8ffbffc15db4370614", false},
+		{`{"$md5": ["abc"]}`, nil, true},
+		{`{"$urlencode": "a b&c=d/é"}`, "a+b%26c%3Dd%2F%C3%A9", false},
+		{`{"$urlencode": {"q": "a b", "page": 2, "all": true}}`, "all=true&page=2&q=a+b", false},
+		{`{"$urlencode": {"q": ["a"]}}`, nil, true},
+		{`{"$urlencode": 3}`, nil, true},
+		{`{"$json": {"b": [1, "<two>"], "a": {"$value": "/one"}}}`, `{"a":"1","b":[1,"<two>"]}`, false},
+		{`{"$json": "quoted"}`, `"quoted"`, false},
+		{`{"$json": null}`, "null", false},
+	})
+}
+
+type fakeHost struct{}
+
+func (fakeHost) Hostname() (string, error) {
+	return "web1.example.com", nil
+}
+
+func (fakeHost) Addrs(name string) ([]net.Addr, error) {
+	addrs := map[string][]string{
+		"":     {"127.0.0.1/8", "::1/128", "10.0.0.1/24", "fe80::1/64"},
+		"lo":   {"127.0.0.1/8", "::1/128"},
+		"eth0": {"10.0.0.1/24", "fe80::1/64"},
+		"eth1": {"fe80::2/64"},
+	}[name]
+	if addrs == nil {
+		return nil, errors.New("no such network interface")
+	}
+	result := make([]net.Addr, 0, len(addrs))
+	for _, addr := range addrs {
+		ip, ipnet, _ := net.ParseCIDR(addr)
+		ipnet.IP = ip
+		result = append(result, ipnet)
+	}
+	return result, nil
+}
+
+func (fakeHost) CPUs() int {
+	return 8
+}
+
+func (fakeHost) Memory() (uint64, error) {
+	return 16 << 30, nil
+}
+
+func (fakeHost) Now() time.Time {
+	return time.Date(2015, 3, 14, 15, 9, 26, 0, time.FixedZone("PDT", -7*60*60))
+}
+
+func TestHostMacros(t *testing.T) {
+	p := newTestPreprocessor(t)
+	p.host = fakeHost{}
+	testMacrosWith(t, p, []macroTest{
+		{`{"$hostname": null}`, "web1.example.com", false},
+		{`{"$ip": null}`, "10.0.0.1", false},
+		{`{"$ip": "lo"}`, "127.0.0.1", false},
+		{`{"$ip": "eth0", "ipv6": true}`, "fe80::1", false},
+		{`{"$ip": "eth1"}`, nil, true},
+		{`{"$ip": "nope"}`, nil, true},
+		{`{"$ip": 0}`, nil, true},
+		{`{"$cpus": null}`, float64(8), false},
+		{`{"$mul": [{"$cpus": null}, 1024]}`, float64(8192), false},
+		{`{"$memory": null}`, float64(16 << 30), false},
+		{`{"$memory": "MB"}`, float64(16 << 10), false},
+		{`{"$memory": "tb"}`, nil, true},
+		{`{"$now": null}`, "2015-03-14T15:09:26-07:00", false},
+		{`{"$now": "2006-01-02 15:04", "utc": true}`, "2015-03-14 22:09", false},
+		{`{"$now": "unix"}`, float64(1426370966), false},
+	})
+
+	// without a provider the real host is used
+	testMacros(t, []macroTest{
+		{`{"$eq": [{"$cpus": null}, 0]}`, false, false},
+	})
+}
+
+func TestDefaults(t *testing.T) {
+	testMacros(t, []macroTest{
+		{`{"$value": "/missing", "default": {"a": [1]}}`, map[string]interface{}{"a": []interface{}{float64(1)}}, false},
+		{`{"$value": "/missing", "default": {"$value": "/one"}}`, "1", false},
+		{`{"$value": "/one", "default": {"$value": "/missing"}}`, "1", false},
+		{`{"$value": "/missing", "default": null}`, nil, false},
+		{`{"$value": "/unavailable", "default": 1}`, nil, true},
+		{`{"$value": "/servers.txt", "as": "number", "default": 1}`, nil, true},
+		{`{"$environ": "CONFIGURATOR_TEST_MISSING", "default": [1]}`, []interface{}{float64(1)}, false},
+		{`{"$include": "/missing.json", "default": {}}`, map[string]interface{}{}, false},
+		{`{"$ref": "#nothing", "default": 5}`, float64(5), false},
+		{`{"$ref": "#nothing"}`, nil, true},
+		{`{"$len": "abc", "default": 0}`, float64(3), false},
+		{`{"$value": {"$value": "/missing"}, "default": 1}`, float64(1), false},
+		{`{"$value": {"$join": ["/app/", {"$environ": "CONFIGURATOR_TEST_MISSING"}]}, "default": "x"}`, "x", false},
+		{`{"$join": [{"$value": "/unavailable"}, {"$value": "/missing"}], "default": "x"}`, nil, true},
+		{`{"$join": [{"$value": "/missing"}, {"$value": "/missing"}]}`, nil, true},
+		{`{"$coalesce": [{"$value": "/missing"}, {"$environ": "CONFIGURATOR_TEST_MISSING"}, "", [], {}, "x"]}`, "x", false},
+		{`{"$coalesce": ["a", {"$value": "/unavailable"}]}`, "a", false},
+		{`{"$coalesce": [0, 1]}`, float64(0), false},
+		{`{"$coalesce": [null, {"$value": "/unavailable"}, 1]}`, nil, true},
+		{`{"$coalesce": [{"$join": [{"$value": "/missing"}]}, 1]}`, float64(1), false},
+		{`{"$coalesce": []}`, nil, false},
+		{`{"$coalesce": [null], "default": "d"}`, "d", false},
+		{`{"$coalesce": "a"}`, nil, true},
+	})
+}
+
+func TestMacroDocs(t *testing.T) {
+	p := newTestPreprocessor(t)
+	p.Register("$undocumented", func(input macroinput) (interface{}, error) {
+		return nil, nil
+	})
+	docs := p.Macros()
+	for i, doc := range docs {
+		if i > 0 && docs[i-1].Name >= doc.Name {
+			t.Fatalf("macros are not sorted: %s, %s", docs[i-1].Name, doc.Name)
+		}
+		if doc.Name == "$undocumented" {
+			if len(doc.Args) != 1 || doc.Args[0] != defaultArg {
+				t.Fatalf("undocumented macro was not listed right: %#v", doc)
+			}
+			continue
+		}
+		if doc.Description == "" || len(doc.Args) == 0 || doc.Args[0].Name != doc.Name {
+			t.Fatalf("%s is not documented right: %#v", doc.Name, doc)
+		}
+	}
+	for name, _ := range p.macros {
+		if _, described := p.docs[name]; !described && name != "$undocumented" {
+			t.Fatalf("%s is not documented", name)
+		}
+	}
+	for name, _ := range p.docs {
+		if _, registered := p.macros[name]; !registered && name != "$set" && name != "$def" {
+			t.Fatalf("%s is documented but not registered", name)
+		}
+	}
+}
+
+// lookupConfig returns a config referring to 20 keys under /app, 10 times
+// each, and the values of the keys.
+func lookupConfig() (string, map[string]string) {
+	values := make(map[string]string)
+	refs := make([]string, 0, 200)
+	for i := 0; i < 200; i++ {
+		key := fmt.Sprintf("/app/key%d", i%20)
+		values[key] = fmt.Sprint(i % 20)
+		refs = append(refs, fmt.Sprintf(`{"$value": "%s"}`, key))
+	}
+	return `{"refs": [` + strings.Join(refs, ",") + `]}`, values
+}
+
+func newLookupPreprocessor(t testing.TB, store ConfigStore) *Preprocessor {
+	config, err := NewConfig(store, "", "", "", "")
+	if err != nil {
+		t.Fatalf("failed to make config: %v", err)
+	}
+	return config.preprocessor
+}
+
+func TestStoreLookups(t *testing.T) {
+	input, values := lookupConfig()
+	store := newCountingStore(values)
+	p := newLookupPreprocessor(t, store)
+	for render := 1; render <= 2; render++ {
+		result, err := preprocessJson(t, p, input)
+		expectErrors(t, err)
+		if v := result.Get("/refs/199"); v != "19" {
+			t.Fatalf("refs did not preprocess right: %#v", v)
+		}
+		if store.gets != 20*render {
+			t.Fatalf("store was not only asked once per key and render: %d gets", store.gets)
+		}
+	}
+
+	store = newCountingStore(values)
+	p = newLookupPreprocessor(t, prefetchingStore{store})
+	result, err := preprocessJson(t, p, `{
+		"refs": `+input+`,
+		"missing": {"$value": "/app/missing", "default": "none"},
+		"dynamic": {"$value": {"$join": ["/app/key", 3]}},
+		"listed": {"$keys": "/app", "values": true}
+	}`)
+	expectErrors(t, err)
+	expected := map[string]interface{}{
+		"/refs/refs/199": "19",
+		"/missing":       "none",
+		"/dynamic":       "3",
+		"/listed/key19":  "19",
+	}
+	for path, value := range expected {
+		if v := result.Get(path); v != value {
+			t.Fatalf("%s did not preprocess right: %#v", path, v)
+		}
+	}
+	if store.gets != 0 || store.lists != 2 {
+		t.Fatalf("store was not prefetched: %d gets, %d lists", store.gets, store.lists)
+	}
+
+	file := writeTempFile(t, `{"x": 1}`)
+	defer os.Remove(file)
+	store = newCountingStore(map[string]string{"prefetch": "p", "keys:/app": "k", "/app/a": "a", "file:" + file: "f"})
+	p = newLookupPreprocessor(t, prefetchingStore{store})
+	result, err = preprocessJson(t, p, `{
+		"prefetch": {"$value": "prefetch"},
+		"keys": [{"$value": "keys:/app"}, {"$keys": "/app"}],
+		"file": [{"$value": "file:`+file+`"}, {"$include": "`+file+`", "from": "file"}]
+	}`)
+	expectErrors(t, err)
+	expected = map[string]interface{}{
+		"/prefetch": "p",
+		"/keys/0":   "k",
+		"/keys/1/0": "a",
+		"/file/0":   "f",
+		"/file/1/x": float64(1),
+	}
+	for path, value := range expected {
+		if v := result.Get(path); v != value {
+			t.Fatalf("%s did not preprocess right: %#v", path, v)
+		}
+	}
+}
+
+func BenchmarkStoreLookups(b *testing.B) {
+	input, values := lookupConfig()
+	tree := new(JsonTree)
+	if err := tree.Load([]byte(input)); err != nil {
+		b.Fatalf("failed to load input: %v", err)
+	}
+	stores := map[string]func(*countingStore) ConfigStore{
+		"get":      func(s *countingStore) ConfigStore { return s },
+		"prefetch": func(s *countingStore) ConfigStore { return prefetchingStore{s} },
+	}
+	for name, wrap := range stores {
+		b.Run(name, func(b *testing.B) {
+			store := newCountingStore(values)
+			p := newLookupPreprocessor(b, wrap(store))
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if _, err := p.Process(tree); err != nil {
+					b.Fatalf("failed to preprocess: %v", err)
+				}
+			}
+			b.ReportMetric(float64(store.gets+store.lists)/float64(b.N), "requests/op")
+		})
+	}
+}
@@ -1,50 +1,996 @@
 package main
 
 import (
+	"errors"
+	"fmt"
 	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
 	"sync"
 )
 
 type macroinput map[string]interface{}
-type macrofn func(macroinput) interface{}
+type macrofn func(macroinput) (interface{}, error)
+
+// String returns the string argument key, which must be present.
+func (input macroinput) String(key string) (string, error) {
+	value, ok := input[key].(string)
+	if !ok {
+		return "", argError(key, "a string", input[key])
+	}
+	return value, nil
+}
+
+// OptionalString returns the string argument key, or "" if not present.
+func (input macroinput) OptionalString(key string) (string, error) {
+	if input[key] == nil {
+		return "", nil
+	}
+	return input.String(key)
+}
+
+// OptionalBool returns the boolean argument key, or false if not present.
+func (input macroinput) OptionalBool(key string) (bool, error) {
+	if input[key] == nil {
+		return false, nil
+	}
+	value, ok := input[key].(bool)
+	if !ok {
+		return false, argError(key, "a boolean", input[key])
+	}
+	return value, nil
+}
+
+// Array returns the array argument key, which must be present.
+func (input macroinput) Array(key string) ([]interface{}, error) {
+	value, ok := input[key].([]interface{})
+	if !ok {
+		return nil, argError(key, "an array", input[key])
+	}
+	return value, nil
+}
+
+func argError(key, expected string, value interface{}) error {
+	return fmt.Errorf("%s expects %s, got %s", key, expected, jsonType(value))
+}
+
+// jsonType names the JSON type of value for error messages.
+func jsonType(value interface{}) string {
+	switch value.(type) {
+	case nil:
+		return "null"
+	case bool:
+		return "boolean"
+	case float64:
+		return "number"
+	case string:
+		return "string"
+	case []interface{}:
+		return "array"
+	case map[string]interface{}:
+		return "object"
+	}
+	return fmt.Sprintf("%T", value)
+}
+
+// MacroError is a macro failing at a path in the tree being processed.
+type MacroError struct {
+	Path  string
+	Macro string
+	Err   error
+}
+
+func (e MacroError) Error() string {
+	return fmt.Sprintf("%s: %s: %v", e.Path, e.Macro, e.Err)
+}
+
+// MacroCall records a macro called at a path in the tree being processed,
+// along with the keys it read. When tracing, it also records the input the
+// macro was called with and what came of it.
+type MacroCall struct {
+	Path    string       `json:"path"`
+	Macro   string       `json:"macro"`
+	Keys    []Dependency `json:"keys,omitempty"`
+	Input   interface{}  `json:"input,omitempty"`
+	Value   interface{}  `json:"value,omitempty"`
+	Omitted bool         `json:"omitted,omitempty"`
+	Default bool         `json:"default,omitempty"`
+	Error   string       `json:"error,omitempty"`
+}
+
+// Modes for processing a tree, combined with |.
+const (
+	recordCalls   = 1 << iota // record every macro called
+	recordTrace               // also record their input and value
+	redactSecrets             // see Report
+	sandboxed                 // see ReportSandboxed
+)
+
+// redacted takes the place of values derived from a secret when reporting.
+const redacted = "[redacted]"
+
+// missingError is returned by macros that found nothing, like a key not in
+// the store, as opposed to failing to look. A default given to the macro is
+// used instead.
+type missingError struct {
+	what string
+}
+
+func (e *missingError) Error() string {
+	return e.what
+}
+
+func missing(what string) error {
+	return &missingError{what}
+}
+
+// PreprocessError collects every macro that failed while processing a tree.
+type PreprocessError struct {
+	Errors []MacroError
+}
+
+func (e PreprocessError) Error() string {
+	messages := make([]string, 0, len(e.Errors))
+	for _, err := range e.Errors {
+		messages = append(messages, err.Error())
+	}
+	return strings.Join(messages, "\n")
+}
+
+type macro struct {
+	fn   macrofn
+	lazy bool
+}
+
+// omit is returned by macros that should remove their node from the
+// enclosing object or array instead of replacing it with a value.
+var omit = &struct{}{}
+
+// scope holds the variables bound while evaluating part of a tree, such as
+// the element of a $for loop. Lookups fall through to the parent scope.
+type scope struct {
+	parent *scope
+	vars   map[string]interface{}
+	defs   map[string]*definition
+}
+
+func (s *scope) lookup(name string) (interface{}, bool) {
+	for ; s != nil; s = s.parent {
+		if value, exists := s.vars[name]; exists {
+			return value, true
+		}
+	}
+	return nil, false
+}
+
+func (s *scope) lookupDef(name string) *definition {
+	for ; s != nil; s = s.parent {
+		if def, exists := s.defs[name]; exists {
+			return def
+		}
+	}
+	return nil
+}
 
 type Preprocessor struct {
 	sync.Mutex
-	macros map[string]macrofn
-	ready  bool
+	macros    map[string]*macro
+	docs      map[string]MacroDoc
+	ready     bool
+	secretKey *[32]byte
+	secrets   Secrets
+	host      HostInfo
+	scope     *scope
+	tree      *JsonTree
+	active    []string
+	depth     int
+	path      string
+	errors    []MacroError
+	mode      int
+	taint     bool
+	lookups   map[Dependency]lookupResult
+	calls     []*MacroCall
+	current   *MacroCall
 }
 
+// Register adds a macro that receives its input with any nested macros
+// already evaluated.
 func (p *Preprocessor) Register(name string, fn macrofn) {
+	p.register(name, &macro{fn: fn})
+}
+
+// RegisterLazy adds a macro that receives its input unevaluated, leaving
+// it to the macro to evaluate only the parts it needs using eval.
+func (p *Preprocessor) RegisterLazy(name string, fn macrofn) {
+	p.register(name, &macro{fn: fn, lazy: true})
+}
+
+func (p *Preprocessor) register(name string, m *macro) {
 	p.Lock()
 	defer p.Unlock()
+	p.init()
+	p.macros[name] = m
+}
+
+func (p *Preprocessor) init() {
 	if !p.ready {
-		p.macros = make(map[string]macrofn)
+		p.macros = make(map[string]*macro)
+		p.docs = make(map[string]MacroDoc)
 		p.ready = true
 	}
-	p.macros[name] = fn
 }
 
-func (p *Preprocessor) Process(tree *JsonTree) *JsonTree {
+// Describe documents a macro for Macros.
+func (p *Preprocessor) Describe(doc MacroDoc) {
+	p.Lock()
+	defer p.Unlock()
+	p.init()
+	p.docs[doc.Name] = doc
+}
+
+// Macros returns the docs of every macro registered or described, sorted by
+// name, with those missing a description listing only their default.
+func (p *Preprocessor) Macros() []MacroDoc {
+	p.Lock()
+	defer p.Unlock()
+	names := make([]string, 0, len(p.macros))
+	for name, _ := range p.macros {
+		names = append(names, name)
+	}
+	for name, _ := range p.docs {
+		if _, registered := p.macros[name]; !registered {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	docs := make([]MacroDoc, 0, len(names))
+	for _, name := range names {
+		doc, described := p.docs[name]
+		if !described {
+			doc = MacroDoc{Name: name}
+		}
+		if _, registered := p.macros[name]; registered {
+			doc.Args = append(append([]MacroArg{}, doc.Args...), defaultArg)
+		}
+		docs = append(docs, doc)
+	}
+	return docs
+}
+
+// Process returns a copy of tree with all macros evaluated. Macros that fail
+// are left null and reported together in a PreprocessError, along with the
+// rest of the processed tree.
+func (p *Preprocessor) Process(tree *JsonTree) (*JsonTree, error) {
+	newtree, _, _, err := p.process(tree, 0)
+	return newtree, err
+}
+
+// Render is Process also returning every macro called, in the order they
+// were called, and the secrets used, to redact from anything the processed
+// tree ends up in.
+func (p *Preprocessor) Render(tree *JsonTree) (*JsonTree, []*MacroCall, Secrets, error) {
+	return p.process(tree, recordCalls)
+}
+
+// Report processes tree to be shown rather than rendered, so the value of
+// any macro derived from a secret is replaced as a whole with [redacted]. It
+// also returns every macro called, with their input and value if trace is
+// set.
+func (p *Preprocessor) Report(tree *JsonTree, trace bool) (*JsonTree, []*MacroCall, error) {
+	mode := recordCalls | redactSecrets
+	if trace {
+		mode |= recordTrace
+	}
+	newtree, calls, _, err := p.process(tree, mode)
+	return newtree, calls, err
+}
+
+// ReportSandboxed is Report for input from outside the config, such as a
+// request to try macros out, where macros reading the process environment or
+// local files fail rather than giving them away.
+func (p *Preprocessor) ReportSandboxed(tree *JsonTree) (*JsonTree, error) {
+	newtree, _, _, err := p.process(tree, redactSecrets|sandboxed)
+	return newtree, err
+}
+
+func (p *Preprocessor) process(tree *JsonTree, mode int) (*JsonTree, []*MacroCall, Secrets, error) {
 	p.Lock()
 	defer p.Unlock()
 	newtree := tree.Copy()
-	for _, namepath := range p.macroPaths(newtree) {
-		name := filepath.Base(namepath)
-		path := filepath.Dir(namepath)
-		input := macroinput(tree.Get(path).(map[string]interface{}))
-		newtree.Replace(path, p.macros[name](input))
+	p.scope = nil
+	p.tree = newtree
+	p.active = nil
+	p.depth = 0
+	p.path = ""
+	p.errors = nil
+	p.mode = mode
+	p.taint = false
+	p.secrets = make(Secrets)
+	p.lookups = make(map[Dependency]lookupResult)
+	p.calls = nil
+	p.current = nil
+	value := p.eval(newtree.Get("/"))
+	if value == omit {
+		value = nil
+	}
+	newtree.Replace("/", value)
+	if len(p.errors) > 0 {
+		return newtree, p.calls, p.secrets, &PreprocessError{p.errors}
+	}
+	return newtree, p.calls, p.secrets, nil
+}
+
+// Dependency identifies something read while processing a tree that can
+// change. Its kind says what: a store key, the keys under a prefix, a service
+// with a tag, the services in the catalog or a local file, so names of
+// different kinds never collide. Lookups are cached by it too, along with
+// kinds that are only cached, like a prefetched prefix.
+type Dependency struct {
+	Kind string `json:"kind"`
+	Name string `json:"name,omitempty"`
+	Tag  string `json:"tag,omitempty"`
+}
+
+// String shows the dependency for people: store keys as they are and
+// anything else prefixed with its kind.
+func (d Dependency) String() string {
+	switch d.Kind {
+	case "key":
+		return d.Name
+	case "services":
+		return d.Kind
+	case "service":
+		return d.Kind + ":" + d.Name + ":" + d.Tag
+	}
+	return d.Kind + ":" + d.Name
+}
+
+type lookupResult struct {
+	value interface{}
+	err   error
+}
+
+// lookup returns what fetch returns for key, only calling it the first time
+// key is looked up while processing a tree, and notes that the macro being
+// called depends on key like read.
+func (p *Preprocessor) lookup(key Dependency, fetch func() (interface{}, error)) (interface{}, error) {
+	p.read(key)
+	return p.memoize(key, fetch)
+}
+
+// memoize is lookup without noting the dependency.
+func (p *Preprocessor) memoize(key Dependency, fetch func() (interface{}, error)) (interface{}, error) {
+	if result, cached := p.lookups[key]; cached {
+		return result.value, result.err
+	}
+	value, err := fetch()
+	p.lookups[key] = lookupResult{value, err}
+	return value, err
+}
+
+// remember caches value for key unless it was already looked up.
+func (p *Preprocessor) remember(key Dependency, value interface{}) {
+	if _, cached := p.lookups[key]; !cached {
+		p.lookups[key] = lookupResult{value, nil}
+	}
+}
+
+// read notes that the macro being called depends on key, which is watched
+// for changes.
+func (p *Preprocessor) read(key Dependency) {
+	if p.current == nil {
+		return
+	}
+	for _, k := range p.current.Keys {
+		if k == key {
+			return
+		}
+	}
+	p.current.Keys = append(p.current.Keys, key)
+}
+
+// fail records err for macro at the path currently being evaluated.
+func (p *Preprocessor) fail(macro string, err error) {
+	p.failAt(p.path, macro, err)
+}
+
+func (p *Preprocessor) failAt(path, macro string, err error) {
+	path = rootPath(path)
+	for _, e := range p.errors {
+		if e.Path == path && e.Macro == macro && e.Err.Error() == err.Error() {
+			return
+		}
+	}
+	p.errors = append(p.errors, MacroError{path, macro, err})
+}
+
+// sandbox returns an error if the tree being processed is sandboxed, and so
+// may not read what is described.
+func (p *Preprocessor) sandbox(what string) error {
+	if p.mode&sandboxed != 0 {
+		return errors.New("cannot read " + what + " here")
+	}
+	return nil
+}
+
+// hostInfo returns the host facts are taken from, the local machine unless
+// another HostInfo was set.
+func (p *Preprocessor) hostInfo() HostInfo {
+	if p.host == nil {
+		return localHost{}
 	}
-	return newtree
+	return p.host
 }
 
-func (p *Preprocessor) macroPaths(t *JsonTree) []string {
-	paths := make([]string, 0)
-	for _, path := range t.Paths() {
-		for name, _ := range p.macros {
-			if filepath.Base(path) == name {
-				paths = append(paths, path)
+// Secrets are the secrets decrypted while processing a tree, and strings
+// derived from them, so they can be redacted from text the tree ends up in.
+type Secrets map[string]bool
+
+// Redact returns text with every secret replaced, longest first so a value
+// derived from a secret is replaced as a whole. Being plain text, every
+// occurrence is, even where it is not the secret that is meant.
+func (s Secrets) Redact(text string) string {
+	secrets := make([]string, 0, len(s))
+	for secret, _ := range s {
+		secrets = append(secrets, secret)
+	}
+	sort.Slice(secrets, func(i, j int) bool { return len(secrets[i]) > len(secrets[j]) })
+	for _, secret := range secrets {
+		text = strings.Replace(text, secret, redacted, -1)
+	}
+	return text
+}
+
+// tainted marks what is being evaluated as derived from a secret, see call.
+func (p *Preprocessor) tainted() {
+	p.taint = true
+}
+
+// conceal records the strings in value as secrets.
+func (p *Preprocessor) conceal(value interface{}) {
+	switch v := value.(type) {
+	case string:
+		if v != "" {
+			p.secrets[v] = true
+		}
+	case []interface{}:
+		for _, elem := range v {
+			p.conceal(elem)
+		}
+	case map[string]interface{}:
+		for k, elem := range v {
+			p.conceal(k)
+			p.conceal(elem)
+		}
+	}
+}
+
+// maxDepth bounds how deeply macros can nest or expand into other macros,
+// which would otherwise recurse forever on a macro producing itself.
+const maxDepth = 64
+
+// eval returns node with all macros in it evaluated, depth first so macro
+// arguments are evaluated before the macro using them, and in sorted key
+// order so evaluation is the same on every render. It must only be called
+// while Process holds the lock, which is the case for any macro.
+func (p *Preprocessor) eval(node interface{}) interface{} {
+	switch n := node.(type) {
+	case map[string]interface{}:
+		if name := p.macroName(n); name != "" {
+			return p.expand(name, n)
+		}
+		if value, isVar := p.variable(n); isVar {
+			return value
+		}
+		if isBinding(n) {
+			// already bound by the enclosing object or array
+			return omit
+		}
+		keys := sortedKeys(n)
+		children := make([]interface{}, 0, len(n))
+		for _, k := range keys {
+			children = append(children, n[k])
+		}
+		defer p.bind(keys, children)()
+		obj := make(map[string]interface{}, len(n))
+		for _, k := range keys {
+			if value := p.evalAt(k, n[k]); value != omit {
+				obj[k] = value
+			}
+		}
+		return obj
+	case []interface{}:
+		keys := make([]string, 0, len(n))
+		for i, _ := range n {
+			keys = append(keys, strconv.Itoa(i))
+		}
+		defer p.bind(keys, n)()
+		arr := make([]interface{}, 0, len(n))
+		for i, v := range n {
+			if value := p.evalAt(keys[i], v); value != omit {
+				arr = append(arr, value)
+			}
+		}
+		return arr
+	}
+	return node
+}
+
+// expand calls a macro and evaluates its result in turn, since a macro may
+// produce other macros, for example from a value fetched from the store.
+func (p *Preprocessor) expand(name string, obj map[string]interface{}) interface{} {
+	if p.depth >= maxDepth {
+		p.fail(name, errors.New("macros nested too deeply"))
+		return nil
+	}
+	p.depth++
+	defer func() { p.depth-- }()
+	return p.eval(p.call(name, obj))
+}
+
+// evalAt evaluates node found at key below the node currently being
+// evaluated, keeping track of the path so errors can point at it.
+func (p *Preprocessor) evalAt(key string, node interface{}) interface{} {
+	parent := p.path
+	p.path = parent + "/" + key
+	defer func() { p.path = parent }()
+	return p.eval(node)
+}
+
+// bind binds any {"$set": ["@name", value]} and {"$def": "name", ...} nodes
+// among children in a new scope, making them visible to the siblings and
+// everything below them. Values are evaluated lazily in that scope on first
+// use, so they can refer to each other regardless of order. The returned func
+// ends the scope.
+func (p *Preprocessor) bind(keys []string, children []interface{}) func() {
+	var frame *scope
+	for i, child := range children {
+		obj, ok := child.(map[string]interface{})
+		if !ok || !isBinding(obj) {
+			continue
+		}
+		if frame == nil {
+			frame = &scope{
+				parent: p.scope,
+				vars:   make(map[string]interface{}),
+				defs:   make(map[string]*definition),
+			}
+			p.scope = frame
+		}
+		path := p.path + "/" + keys[i]
+		if _, isDef := obj["$def"]; isDef {
+			def, err := parseDefinition(obj)
+			if err != nil {
+				p.failAt(path, "$def", err)
+				continue
+			}
+			def.path, def.scope = path, frame
+			frame.defs[def.name] = def
+			continue
+		}
+		if len(obj) != 1 {
+			p.failAt(path, "$set", errors.New("$set must be the only key"))
+			continue
+		}
+		pair, ok := obj["$set"].([]interface{})
+		if !ok || len(pair) != 2 {
+			p.failAt(path, "$set", errors.New("$set expects an array of a variable name and a value"))
+			continue
+		}
+		name, ok := pair[0].(string)
+		if !ok || !strings.HasPrefix(name, "@") {
+			p.failAt(path, "$set", errors.New("$set expects a variable name starting with @"))
+			continue
+		}
+		frame.vars[name] = &binding{name: name, path: path + "/$set/1", node: pair[1], scope: frame}
+	}
+	if frame == nil {
+		return func() {}
+	}
+	return func() { p.scope = frame.parent }
+}
+
+// binding is a variable defined with $set, evaluated on first use.
+type binding struct {
+	name      string
+	path      string
+	node      interface{}
+	scope     *scope
+	value     interface{}
+	evaluated bool
+	resolving bool
+	tainted   bool
+}
+
+func (p *Preprocessor) resolve(b *binding) interface{} {
+	if b.evaluated {
+		p.taint = p.taint || b.tainted
+		return b.value
+	}
+	if b.resolving {
+		p.fail("$set", errors.New("cycle detected resolving "+b.name))
+		return nil
+	}
+	b.resolving = true
+	outer, path, taint := p.scope, p.path, p.taint
+	p.scope, p.path, p.taint = b.scope, b.path, false
+	value := p.eval(b.node)
+	b.tainted = p.taint
+	p.scope, p.path, p.taint = outer, path, taint || b.tainted
+	b.resolving = false
+	if value == omit {
+		value = nil
+	}
+	b.value, b.evaluated = value, true
+	return value
+}
+
+func isBinding(obj map[string]interface{}) bool {
+	if _, exists := obj["$def"]; exists {
+		return true
+	}
+	_, exists := obj["$set"]
+	return exists
+}
+
+// definition is a parameterized snippet declared with $def and instantiated
+// with $call. Params map each parameter to its default, with required
+// parameters having none.
+type definition struct {
+	name   string
+	params map[string]interface{}
+	body   interface{}
+	path   string
+	scope  *scope
+}
+
+var required = &struct{}{}
+
+func parseDefinition(obj map[string]interface{}) (*definition, error) {
+	input := macroinput(obj)
+	name, err := input.String("$def")
+	if err != nil {
+		return nil, err
+	}
+	def := &definition{name: name, params: make(map[string]interface{}), body: obj["body"]}
+	switch params := obj["params"].(type) {
+	case nil:
+	case []interface{}:
+		for _, param := range params {
+			param, ok := param.(string)
+			if !ok || !strings.HasPrefix(param, "@") {
+				return nil, errors.New("params must be variable names starting with @")
+			}
+			def.params[param] = required
+		}
+	case map[string]interface{}:
+		for param, value := range params {
+			if !strings.HasPrefix(param, "@") {
+				return nil, errors.New("params must be variable names starting with @")
+			}
+			def.params[param] = value
+		}
+	default:
+		return nil, argError("params", "an array or object", params)
+	}
+	for k, _ := range obj {
+		if k != "$def" && k != "params" && k != "body" {
+			return nil, errors.New("unknown $def key: " + k)
+		}
+	}
+	return def, nil
+}
+
+// instantiate evaluates the body of the definition called name with args
+// bound to its params. Like closures, the body sees the scope the
+// definition was declared in rather than the scope of the caller.
+func (p *Preprocessor) instantiate(name string, args map[string]interface{}) (interface{}, error) {
+	def := p.scope.lookupDef(name)
+	if def == nil {
+		return nil, errors.New("no definition in scope: " + name)
+	}
+	vars := make(map[string]interface{}, len(def.params))
+	for param, value := range def.params {
+		if arg, exists := args[param]; exists {
+			vars[param] = arg
+		} else if value == required {
+			return nil, fmt.Errorf("missing argument for %s: %s", name, param)
+		} else {
+			vars[param] = &binding{name: param, path: def.path + "/params/" + param, node: value, scope: def.scope}
+		}
+	}
+	for arg, _ := range args {
+		if _, exists := def.params[arg]; !exists {
+			return nil, fmt.Errorf("unknown argument for %s: %s", name, arg)
+		}
+	}
+	outer, path := p.scope, p.path
+	p.scope, p.path = &scope{parent: def.scope, vars: vars}, def.path
+	defer func() { p.scope, p.path = outer, path }()
+	return p.evalAt("body", def.body), nil
+}
+
+// evalWith evaluates node at key like evalAt, but with vars bound in a new
+// scope on top of the current one, shadowing outer variables of that name.
+func (p *Preprocessor) evalWith(vars map[string]interface{}, key string, node interface{}) interface{} {
+	p.scope = &scope{parent: p.scope, vars: vars}
+	defer func() { p.scope = p.scope.parent }()
+	return p.evalAt(key, node)
+}
+
+// variable resolves objects of the form {"@name": null}, or
+// {"@name": "path/in/value"} to select part of the bound value. Such an
+// object naming a variable that is not bound fails rather than being
+// passed through, since that is most likely a misspelt name.
+func (p *Preprocessor) variable(obj map[string]interface{}) (interface{}, bool) {
+	if len(obj) != 1 {
+		return nil, false
+	}
+	for k, v := range obj {
+		if !strings.HasPrefix(k, "@") {
+			return nil, false
+		}
+		value, bound := p.lookupVariable(k)
+		path, isPath := v.(string)
+		if !bound {
+			if v != nil && !isPath {
+				return nil, false
+			}
+			p.fail(k, missing("variable not bound: "+k))
+			return nil, true
+		}
+		if isPath && path != "" {
+			return (&JsonTree{root: value}).Get(path), true
+		}
+		return value, true
+	}
+	return nil, false
+}
+
+// lookupVariable returns the value bound to name, evaluating it if need be.
+func (p *Preprocessor) lookupVariable(name string) (interface{}, bool) {
+	value, bound := p.scope.lookup(name)
+	if b, ok := value.(*binding); ok {
+		value = p.resolve(b)
+	}
+	return value, bound
+}
+
+// evalPath evaluates the node at path in the tree being processed. If path
+// points inside something produced by a macro, the closest node that does
+// exist is evaluated and the rest of the path is selected from its value.
+func (p *Preprocessor) evalPath(path string) (interface{}, error) {
+	node := path
+	for p.tree.Get(node) == nil && node != "/" {
+		node = filepath.Dir(node)
+	}
+	if node != path && !p.producesValue(p.tree.Get(node)) {
+		return nil, missing("reference not found: #" + strings.TrimPrefix(path, "/"))
+	}
+	if err := p.enter("#" + strings.TrimPrefix(node, "/")); err != nil {
+		return nil, err
+	}
+	defer p.leave()
+	outer, parent := p.scope, p.path
+	p.scope = p.scopeAt(node)
+	p.path = strings.TrimSuffix(node, "/")
+	defer func() { p.scope, p.path = outer, parent }()
+	value := p.eval(p.tree.Get(node))
+	if node == path {
+		return value, nil
+	}
+	return (&JsonTree{root: value}).Get(strings.TrimPrefix(path, node)), nil
+}
+
+// scopeAt returns the scope the node at path is evaluated in as part of the
+// tree, binding the $set and $def nodes among the siblings of each of its
+// ancestors, rather than whatever scope the caller is in.
+func (p *Preprocessor) scopeAt(path string) *scope {
+	outer, parent := p.scope, p.path
+	defer func() { p.scope, p.path = outer, parent }()
+	p.scope, p.path = nil, ""
+	node := p.tree.Get("/")
+	for _, key := range strings.Split(strings.Trim(path, "/"), "/") {
+		if key == "" {
+			break
+		}
+		switch n := node.(type) {
+		case map[string]interface{}:
+			if p.macroName(n) == "" {
+				keys := sortedKeys(n)
+				children := make([]interface{}, 0, len(n))
+				for _, k := range keys {
+					children = append(children, n[k])
+				}
+				p.bind(keys, children)
+			}
+			node = n[key]
+		case []interface{}:
+			keys := make([]string, 0, len(n))
+			for i, _ := range n {
+				keys = append(keys, strconv.Itoa(i))
+			}
+			p.bind(keys, n)
+			i, _ := strconv.Atoi(key)
+			node = n[i]
+		}
+		p.path += "/" + key
+	}
+	return p.scope
+}
+
+// producesValue reports whether node is a macro or variable, whose value is
+// only known once evaluated.
+func (p *Preprocessor) producesValue(node interface{}) bool {
+	obj, ok := node.(map[string]interface{})
+	if !ok {
+		return false
+	}
+	if p.macroName(obj) != "" {
+		return true
+	}
+	for k, _ := range obj {
+		return len(obj) == 1 && strings.HasPrefix(k, "@")
+	}
+	return false
+}
+
+// enter marks id as being evaluated until the matching leave, returning an
+// error if it already is, since that means it ended up depending on itself.
+func (p *Preprocessor) enter(id string) error {
+	for i, active := range p.active {
+		if active == id {
+			cycle := append(append([]string{}, p.active[i:]...), id)
+			return fmt.Errorf("cycle detected: %s", strings.Join(cycle, " -> "))
+		}
+	}
+	p.active = append(p.active, id)
+	return nil
+}
+
+func (p *Preprocessor) leave() {
+	p.active = p.active[:len(p.active)-1]
+}
+
+// call calls a macro with its input, evaluated unless the macro is lazy.
+// Any macro can be given a default, which takes the place of the value if the
+// macro or any of its arguments finds nothing, like a $coalesce of one, and
+// is only evaluated then.
+//
+// A macro is tainted if a secret was decrypted or used while calling it,
+// which makes its value and any error secret too. Taint spreads to the
+// macros around it, even lazy ones that only pass a tainted value on.
+func (p *Preprocessor) call(name string, obj map[string]interface{}) interface{} {
+	m := p.macros[name]
+	taint := p.taint
+	p.taint = false
+	outer, call := p.current, (*MacroCall)(nil)
+	if p.mode&recordCalls != 0 {
+		call = &MacroCall{Path: rootPath(p.path), Macro: name}
+		p.calls = append(p.calls, call)
+	}
+	p.current = call
+	mark := len(p.errors)
+	input := macroinput(obj)
+	if !m.lazy {
+		input = make(macroinput, len(obj))
+		for _, k := range sortedKeys(obj) {
+			if k == "default" {
+				continue
+			}
+			if value := p.evalAt(k, obj[k]); value != omit {
+				input[k] = value
 			}
 		}
 	}
-	return paths
+	node, hasDefault := obj["default"]
+	var value interface{}
+	var err error
+	if argErr := p.missingSince(mark); hasDefault && argErr != nil {
+		// an argument was missing, so the result is too
+		err = argErr
+	} else {
+		value, err = m.fn(input)
+	}
+	p.current = outer
+	if hasDefault {
+		if _, isMissing := err.(*missingError); isMissing || (err == nil && value == nil) {
+			p.dropMissing(mark)
+			value, err = p.evalAt("default", node), nil
+			if call != nil {
+				call.Default = true
+			}
+		}
+	}
+	tainted := p.taint
+	if tainted && err != nil {
+		err = errors.New("failed on a value derived from a secret")
+	}
+	if err != nil {
+		p.fail(name, err)
+		value = nil
+	}
+	if tainted && p.mode&redactSecrets != 0 {
+		value = redacted
+	} else if tainted && !m.lazy {
+		p.conceal(value)
+	}
+	p.taint = taint || tainted
+	if p.mode&recordTrace != 0 {
+		call.Input = map[string]interface{}(input)
+		call.Value, call.Omitted = value, value == omit
+		if call.Omitted {
+			call.Value = nil
+		}
+		if err != nil {
+			call.Error = err.Error()
+		}
+	}
+	return value
+}
+
+// evalOptional evaluates node at key like evalAt, except that should nothing
+// come of it, errors from macros that found nothing are dropped, as if they
+// had been given a null default.
+func (p *Preprocessor) evalOptional(key string, node interface{}) interface{} {
+	mark := len(p.errors)
+	value := p.evalAt(key, node)
+	if empty(value) {
+		p.dropMissing(mark)
+	}
+	return value
+}
+
+// missingSince returns the first error recorded since mark from a macro that
+// found nothing, if any.
+func (p *Preprocessor) missingSince(mark int) error {
+	for _, e := range p.errors[mark:] {
+		if _, isMissing := e.Err.(*missingError); isMissing {
+			return e.Err
+		}
+	}
+	return nil
+}
+
+// dropMissing drops the errors recorded since mark from macros that found
+// nothing, for when a default takes the place of what they would have found.
+func (p *Preprocessor) dropMissing(mark int) {
+	kept := p.errors[:mark]
+	for _, e := range p.errors[mark:] {
+		if _, isMissing := e.Err.(*missingError); !isMissing {
+			kept = append(kept, e)
+		}
+	}
+	p.errors = kept
+}
+
+// macroName returns the macro obj invokes. Should obj have more than one
+// macro key, the first in sorted order wins.
+func (p *Preprocessor) macroName(obj map[string]interface{}) string {
+	for _, k := range sortedKeys(obj) {
+		if !strings.HasPrefix(k, "$") {
+			continue
+		}
+		if _, exists := p.macros[k]; exists {
+			return k
+		}
+	}
+	return ""
+}
+
+func rootPath(path string) string {
+	if path == "" {
+		return "/"
+	}
+	return path
+}
+
+func sortedKeys(obj map[string]interface{}) []string {
+	keys := make([]string, 0, len(obj))
+	for k, _ := range obj {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
 }
@@ -1,6 +1,11 @@
 package main
 
-import "testing"
+import (
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+)
 
 const (
 	json_preprocess = `{
@@ -20,8 +25,131 @@ const (
 			"$value": "/three"
 		}
 	}`
+
+	json_environ = `{
+		"bind": {
+			"$environ": "CONFIGURATOR_TEST_BIND"
+		},
+		"workers": {
+			"$environ": "CONFIGURATOR_TEST_WORKERS",
+			"as": "number"
+		},
+		"daemon": {
+			"$environ": "CONFIGURATOR_TEST_DAEMON",
+			"as": "bool"
+		},
+		"missing": {
+			"$environ": "CONFIGURATOR_TEST_MISSING",
+			"default": 4
+		},
+		"missing_no_default": {
+			"$environ": "CONFIGURATOR_TEST_MISSING"
+		}
+	}`
+
+	json_conditionals = `{
+		"eq": {"$eq": [{"$value": "/one"}, "1"]},
+		"eq_many": {"$eq": [1, 1, 2]},
+		"ne": {"$ne": [{"$value": "/one"}, {"$value": "/two"}]},
+		"and": {"$and": [true, {"$value": "/one"}, {"$not": false}]},
+		"or": {"$or": [false, "", {"$value": "non_existing_path"}]},
+		"not": {"$not": []},
+		"then": {
+			"$if": {"$eq": [{"$value": "/two"}, "2"]},
+			"then": {"server": {"$value": "/three"}},
+			"else": "nope"
+		},
+		"else": {
+			"$if": {"$ne": [{"$environ": "CONFIGURATOR_TEST_ENV"}, "production"]},
+			"then": "nope",
+			"else": {"$value": "/one"}
+		},
+		"omitted": {
+			"$if": {"$or": [false, false]},
+			"then": "nope"
+		},
+		"list": [
+			"upstream",
+			{"$if": false, "then": "nope"},
+			{"$if": true, "then": "downstream"}
+		]
+	}`
 )
 
+const (
+	json_for = `{
+		"upstream": {
+			"$for": "@server",
+			"in": [
+				{"host": "a.example.com", "port": 80},
+				{"host": "b.example.com", "port": {"$value": "/three"}}
+			],
+			"index": "@i",
+			"loop": {"server": {"@server": "host"}, "port": {"@server": "port"}, "n": {"@i": null}}
+		},
+		"keyed": {
+			"$for": "@port",
+			"in": {"web": 80, "admin": 8080},
+			"index": "@name",
+			"key": {"@name": null},
+			"loop": {"listen": {"@port": null}}
+		},
+		"nested": {
+			"$for": "@x",
+			"in": [1, 2],
+			"loop": {
+				"$for": "@x",
+				"in": [{"@x": null}],
+				"loop": ["shadowed", {"@x": null}]
+			}
+		},
+		"empty": {
+			"$for": "@service",
+			"in": [],
+			"loop": ["upstream", {"@service": null}],
+			"else": ["noupstream"]
+		},
+		"unbound": {"@nothing": null},
+		"literal": {"@nothing": 1}
+	}`
+)
+
+func preprocessJson(t *testing.T, p *Preprocessor, input string) (*JsonTree, error) {
+	preprocess := &JsonTree{}
+	if err := preprocess.Load([]byte(input)); err != nil {
+		t.Fatalf("failed to load input to preprocess, %v", err)
+	}
+	return p.Process(preprocess)
+}
+
+// expectErrors fails unless err reports macro errors at exactly paths.
+func expectErrors(t *testing.T, err error, paths ...string) {
+	if len(paths) == 0 {
+		if err != nil {
+			t.Fatalf("failed to preprocess: %v", err)
+		}
+		return
+	}
+	e, ok := err.(*PreprocessError)
+	if !ok {
+		t.Fatalf("expected errors at %v, got: %v", paths, err)
+	}
+	if len(e.Errors) != len(paths) {
+		t.Fatalf("expected errors at %v, got:\n%v", paths, err)
+	}
+	for i, path := range paths {
+		if e.Errors[i].Path != path {
+			t.Fatalf("expected errors at %v, got:\n%v", paths, err)
+		}
+	}
+}
+
+func newTestPreprocessor(t *testing.T) *Preprocessor {
+	p := &Preprocessor{}
+	loadBuiltinMacros(p, NewTestStore())
+	return p
+}
+
 func TestPreprocessor(t *testing.T) {
 	p := &Preprocessor{}
 
@@ -34,7 +162,7 @@ func TestPreprocessor(t *testing.T) {
 
 	config.cmdRunner = testCmd
 
-	loadBuiltinMacros(p, store, config)
+	loadBuiltinMacros(p, store)
 
 	preprocess := &JsonTree{}
 
@@ -44,7 +172,8 @@ func TestPreprocessor(t *testing.T) {
 		t.Fatalf("failed to load input to preprocess, %v", err)
 	}
 
-	result := p.Process(preprocess)
+	result, err := p.Process(preprocess)
+	expectErrors(t, err, "/but_this_doesn't_exist")
 
 	if preprocess_this := result.Get("/preprocess_this"); preprocess_this != "1" {
 		t.Fatalf("preprocess_this did not preprocess right: %v", preprocess_this)
@@ -54,7 +183,7 @@ func TestPreprocessor(t *testing.T) {
 		t.Fatalf("and_this did not preprocess right: %v", and_this)
 	}
 
-	if btde := result.Get("/but_this_doesn't_exist"); btde != "" {
+	if btde := result.Get("/but_this_doesn't_exist"); btde != nil {
 		t.Fatalf("but_this_doesn't_exist did not preprocess right: %v", btde)
 	}
 
@@ -62,3 +191,539 @@ func TestPreprocessor(t *testing.T) {
 		t.Fatalf("also_three did not preprocess right: %v", also_three)
 	}
 }
+
+func TestPreprocessorEnviron(t *testing.T) {
+	p := &Preprocessor{}
+
+	store := NewTestStore()
+
+	loadBuiltinMacros(p, store)
+
+	os.Setenv("CONFIGURATOR_TEST_BIND", "127.0.0.1:8080")
+	os.Setenv("CONFIGURATOR_TEST_WORKERS", "8")
+	os.Setenv("CONFIGURATOR_TEST_DAEMON", "true")
+	os.Unsetenv("CONFIGURATOR_TEST_MISSING")
+	defer os.Unsetenv("CONFIGURATOR_TEST_BIND")
+	defer os.Unsetenv("CONFIGURATOR_TEST_WORKERS")
+	defer os.Unsetenv("CONFIGURATOR_TEST_DAEMON")
+
+	preprocess := &JsonTree{}
+	err := preprocess.Load([]byte(json_environ))
+	if err != nil {
+		t.Fatalf("failed to load input to preprocess, %v", err)
+	}
+
+	result, err := p.Process(preprocess)
+	expectErrors(t, err, "/missing_no_default")
+
+	if bind := result.Get("/bind"); bind != "127.0.0.1:8080" {
+		t.Fatalf("bind did not preprocess right: %v", bind)
+	}
+
+	if workers := result.Get("/workers"); workers != float64(8) {
+		t.Fatalf("workers did not preprocess right: %#v", workers)
+	}
+
+	if daemon := result.Get("/daemon"); daemon != true {
+		t.Fatalf("daemon did not preprocess right: %#v", daemon)
+	}
+
+	if missing := result.Get("/missing"); missing != float64(4) {
+		t.Fatalf("missing did not preprocess right: %#v", missing)
+	}
+
+	if missing := result.Get("/missing_no_default"); missing != nil {
+		t.Fatalf("missing_no_default did not preprocess right: %#v", missing)
+	}
+}
+
+func TestPreprocessorConditionals(t *testing.T) {
+	p := newTestPreprocessor(t)
+
+	os.Setenv("CONFIGURATOR_TEST_ENV", "production")
+	defer os.Unsetenv("CONFIGURATOR_TEST_ENV")
+
+	result, err := preprocessJson(t, p, json_conditionals)
+	expectErrors(t, err, "/or/$or/2")
+
+	expected := map[string]interface{}{
+		"/eq":          true,
+		"/eq_many":     false,
+		"/ne":          true,
+		"/and":         true,
+		"/or":          false,
+		"/not":         true,
+		"/then/server": "3",
+		"/else":        "1",
+		"/list/0":      "upstream",
+		"/list/1":      "downstream",
+	}
+	for path, value := range expected {
+		if v := result.Get(path); v != value {
+			t.Fatalf("%s did not preprocess right: %#v", path, v)
+		}
+	}
+
+	if _, exists := result.Get("/").(map[string]interface{})["omitted"]; exists {
+		t.Fatalf("omitted was not removed: %#v", result.Get("/omitted"))
+	}
+
+	if list := result.Get("/list").([]interface{}); len(list) != 2 {
+		t.Fatalf("list did not omit false branch: %#v", list)
+	}
+}
+
+func TestPreprocessorFor(t *testing.T) {
+	p := newTestPreprocessor(t)
+
+	result, err := preprocessJson(t, p, json_for)
+	expectErrors(t, err, "/unbound")
+
+	expected := map[string]interface{}{
+		"/upstream/0/server":  "a.example.com",
+		"/upstream/0/port":    float64(80),
+		"/upstream/0/n":       float64(0),
+		"/upstream/1/server":  "b.example.com",
+		"/upstream/1/port":    "3",
+		"/upstream/1/n":       float64(1),
+		"/keyed/web/listen":   float64(80),
+		"/keyed/admin/listen": float64(8080),
+		"/nested/0/0/0":       "shadowed",
+		"/nested/0/0/1":       float64(1),
+		"/nested/1/0/1":       float64(2),
+		"/empty/0":            "noupstream",
+		"/unbound":            nil,
+		"/literal/@nothing":   float64(1),
+	}
+	for path, value := range expected {
+		if v := result.Get(path); v != value {
+			t.Fatalf("%s did not preprocess right: %#v", path, v)
+		}
+	}
+
+	if e := err.(*PreprocessError).Errors[0]; e.Macro != "@nothing" || e.Err.Error() != "variable not bound: @nothing" {
+		t.Fatalf("unbound variable was not reported right: %v", e)
+	}
+}
+
+func TestPreprocessorRef(t *testing.T) {
+	p := newTestPreprocessor(t)
+
+	result, err := preprocessJson(t, p, `{
+		"timeouts": {"connect": 5000, "server": {"$value": "/one"}},
+		"frontend": {"timeout": {"$ref": "#timeouts"}},
+		"backend": {"timeout": {"$ref": "#/frontend/timeout/server"}},
+		"chained": {"$ref": "#backend"},
+		"loop_a": {"$ref": "#loop_b"},
+		"loop_b": {"$ref": "#loop_a"},
+		"self": {"x": {"$ref": "#self"}}
+	}`)
+	expectErrors(t, err, "/loop_a", "/loop_b", "/self/x")
+
+	expected := map[string]interface{}{
+		"/frontend/timeout/connect": float64(5000),
+		"/frontend/timeout/server":  "1",
+		"/backend/timeout":          "1",
+		"/chained/timeout":          "1",
+		"/loop_a":                   nil,
+		"/loop_b":                   nil,
+		"/self/x/x":                 nil,
+	}
+	for path, value := range expected {
+		if v := result.Get(path); v != value {
+			t.Fatalf("%s did not preprocess right: %#v", path, v)
+		}
+	}
+
+	p.enter("#a")
+	p.enter("#b")
+	err = p.enter("#a")
+	if err == nil || err.Error() != "cycle detected: #a -> #b -> #a" {
+		t.Fatalf("cycle was not detected: %v", err)
+	}
+}
+
+func TestPreprocessorRefScope(t *testing.T) {
+	p := newTestPreprocessor(t)
+
+	result, err := preprocessJson(t, p, `{
+		"x": {"s": {"$set": ["@t", 5]}, "b": {"@t": null}},
+		"y": {"$ref": "#x/b"},
+		"loop": {"$for": "@t", "in": [1], "loop": {"$ref": "#x/b"}}
+	}`)
+	expectErrors(t, err)
+
+	expected := map[string]interface{}{
+		"/x/b":    float64(5),
+		"/y":      float64(5),
+		"/loop/0": float64(5),
+	}
+	for path, value := range expected {
+		if v := result.Get(path); v != value {
+			t.Fatalf("%s did not preprocess right: %#v", path, v)
+		}
+	}
+}
+
+func TestPreprocessorSet(t *testing.T) {
+	p := newTestPreprocessor(t)
+
+	result, err := preprocessJson(t, p, `{
+		"_port": {"$set": ["@port", {"$value": "/three"}]},
+		"_host": {"$set": ["@host", "localhost"]},
+		"_listen": {"$set": ["@listen", [{"@host": null}, {"@port": null}]]},
+		"listen": {"@listen": null},
+		"server": {
+			"_host": {"$set": ["@host", "example.com"]},
+			"host": {"@host": null},
+			"port": {"@port": null}
+		},
+		"list": [
+			{"$set": ["@a", 1]},
+			{"@a": null},
+			{"$set": ["@a", 2]},
+			[{"$set": ["@a", "inner"]}, {"@a": null}]
+		],
+		"cycle": {
+			"_x": {"$set": ["@x", {"@y": null}]},
+			"_y": {"$set": ["@y", {"@x": null}]},
+			"x": {"@x": null}
+		},
+		"host": {"@host": null},
+		"loop": {
+			"$for": "@host",
+			"in": ["a", "b"],
+			"loop": [{"$set": ["@port", 80]}, {"@host": null}, {"@port": null}]
+		}
+	}`)
+	expectErrors(t, err, "/cycle/_y/$set/1")
+
+	expected := map[string]interface{}{
+		"/listen/0":    "localhost",
+		"/listen/1":    "3",
+		"/server/host": "example.com",
+		"/server/port": "3",
+		"/list/0":      float64(2),
+		"/cycle/x":     nil,
+		"/list/1/0":    "inner",
+		"/host":        "localhost",
+		"/loop/0/0":    "a",
+		"/loop/0/1":    float64(80),
+		"/loop/1/0":    "b",
+	}
+	for path, value := range expected {
+		if v := result.Get(path); v != value {
+			t.Fatalf("%s did not preprocess right: %#v", path, v)
+		}
+	}
+
+	for _, key := range []string{"_port", "_host", "_listen"} {
+		if _, exists := result.Get("/").(map[string]interface{})[key]; exists {
+			t.Fatalf("%s was not removed", key)
+		}
+	}
+	if list := result.Get("/list").([]interface{}); len(list) != 2 {
+		t.Fatalf("$set was not removed from list: %#v", list)
+	}
+}
+
+func TestPreprocessorKeys(t *testing.T) {
+	p := newTestPreprocessor(t)
+
+	result, err := preprocessJson(t, p, `{
+		"names": {"$keys": "/vhosts"},
+		"vhosts": {"$keys": "/vhosts/", "values": true},
+		"empty": {"$keys": "/nothing"}
+	}`)
+	expectErrors(t, err)
+
+	expected := map[string]interface{}{
+		"/names/0":              "a.example.com",
+		"/names/1":              "b.example.com",
+		"/vhosts/a.example.com": "server a",
+		"/vhosts/b.example.com": "server b",
+	}
+	for path, value := range expected {
+		if v := result.Get(path); v != value {
+			t.Fatalf("%s did not preprocess right: %#v", path, v)
+		}
+	}
+	if empty := result.Get("/empty").([]interface{}); len(empty) != 0 {
+		t.Fatalf("empty did not preprocess right: %#v", empty)
+	}
+}
+
+const json_nested = `{
+		"_paths": {"$set": ["@paths", ["/one", "/two", "/three"]]},
+		"deep": {
+			"$for": "@path",
+			"in": {"@paths": null},
+			"loop": {
+				"$if": {
+					"$and": [
+						{"$not": {"$eq": [{"@path": null}, "/two"]}},
+						{"$or": [
+							{"$eq": [{"$wrap": {"@path": null}}, "1"]},
+							{"$eq": [{"$ref": "#values/three"}, {"$value": {"@path": null}}]}
+						]}
+					]
+				},
+				"then": {"path": {"@path": null}, "value": {"$wrap": {"@path": null}}},
+				"else": {"$if": {"$eq": [{"@path": null}, "/two"]}}
+			}
+		},
+		"values": {"three": {"$wrap": {"$ref": "#paths/2"}}},
+		"paths": {"@paths": null},
+		"produced": {"$wrap": "/one"},
+		"ambiguous": {"$eq": [1, 1], "$ne": [1, 1]},
+		"forever": {"$forever": true}
+	}`
+
+func TestPreprocessorNested(t *testing.T) {
+	p := newTestPreprocessor(t)
+	p.Register("$wrap", func(input macroinput) (interface{}, error) {
+		return map[string]interface{}{"$value": input["$wrap"]}, nil
+	})
+	p.Register("$forever", func(input macroinput) (interface{}, error) {
+		return map[string]interface{}{"$forever": input["$forever"]}, nil
+	})
+
+	result, err := preprocessJson(t, p, json_nested)
+	expectErrors(t, err, "/forever")
+
+	expected := map[string]interface{}{
+		"/deep/0/path":  "/one",
+		"/deep/0/value": "1",
+		"/deep/1/path":  "/three",
+		"/deep/1/value": "3",
+		"/values/three": "3",
+		"/produced":     "1",
+		"/ambiguous":    true,
+		"/forever":      nil,
+	}
+	for path, value := range expected {
+		if v := result.Get(path); v != value {
+			t.Fatalf("%s did not preprocess right: %#v", path, v)
+		}
+	}
+	if deep := result.Get("/deep").([]interface{}); len(deep) != 2 {
+		t.Fatalf("deep did not omit /two: %#v", deep)
+	}
+
+	first := string(result.Dump())
+	for i := 0; i < 20; i++ {
+		again, _ := preprocessJson(t, p, json_nested)
+		if string(again.Dump()) != first {
+			t.Fatalf("output is not stable across renders:\n%s\n%s", first, again.Dump())
+		}
+	}
+}
+
+func TestPreprocessorErrors(t *testing.T) {
+	p := newTestPreprocessor(t)
+
+	result, err := preprocessJson(t, p, `{
+		"ok": {"$value": "/one"},
+		"not_a_string": {"$value": 3},
+		"unavailable": {"$value": "/unavailable", "default": "nope"},
+		"nested": {"server": {"$eq": [{"$value": "/missing"}, null]}},
+		"bad_set": [{"$set": ["foo", 1]}],
+		"set_extra": {"x": {"$set": ["@a", 1], "other": 2}, "y": {"@a": null}},
+		"bad_ref": {"$ref": "foo"},
+		"neg_ref": {"a": {"$ref": "#neg_ref/list/-1"}, "list": [1]},
+		"neg_sort": {"$sort": [[1], [2]], "by": "-1"},
+		"neg_var": {"$for": "@x", "in": [[1]], "loop": {"@x": "-1"}},
+		"bad_for": {"$for": "@x", "in": "abc", "loop": null},
+		"untaken": {"$if": true, "then": "fine", "else": {"$value": "/missing"}}
+	}`)
+
+	expectErrors(t, err,
+		"/bad_for",
+		"/bad_ref",
+		"/bad_set/0",
+		"/neg_ref/a",
+		"/neg_sort",
+		"/nested/server/$eq/0",
+		"/not_a_string",
+		"/set_extra/x",
+		"/set_extra/y",
+		"/unavailable",
+	)
+	if ok := result.Get("/ok"); ok != "1" {
+		t.Fatalf("ok did not preprocess right: %#v", ok)
+	}
+	if nested := result.Get("/nested/server"); nested != true {
+		t.Fatalf("nested did not preprocess right: %#v", nested)
+	}
+	if untaken := result.Get("/untaken"); untaken != "fine" {
+		t.Fatalf("untaken did not preprocess right: %#v", untaken)
+	}
+	if neg := result.Get("/neg_var/0"); neg != nil {
+		t.Fatalf("negative index did not select nothing: %#v", neg)
+	}
+	if extra := result.Get("/set_extra"); len(extra.(map[string]interface{})) != 1 {
+		t.Fatalf("$set with other keys was passed through: %#v", extra)
+	}
+
+	e := err.(*PreprocessError).Errors[6]
+	if e.Error() != "/not_a_string: $value: $value expects a string, got number" {
+		t.Fatalf("error is not descriptive: %v", e)
+	}
+}
+
+func TestPreprocessorDefinitions(t *testing.T) {
+	p := newTestPreprocessor(t)
+
+	result, err := preprocessJson(t, p, `{
+		"_location": {
+			"$def": "location",
+			"params": {"@path": null, "@backend": "app", "@timeout": {"$value": "/three"}},
+			"body": {
+				"proxy_pass": {"$ref": "#backends/0"},
+				"backend": {"@backend": null},
+				"path": {"@path": null},
+				"proxy_read_timeout": {"@timeout": null}
+			}
+		},
+		"_server": {
+			"$def": "server",
+			"params": ["@name"],
+			"body": {
+				"server_name": {"@name": null},
+				"location": [
+					{"$call": "location", "args": {"@path": "/"}},
+					{"$call": "location", "args": {"@path": "/api", "@backend": {"@name": null}}}
+				]
+			}
+		},
+		"backends": ["http://127.0.0.1"],
+		"http": {
+			"_backend": {"$set": ["@backend", "shadowed"]},
+			"server": {"$call": "server", "args": {"@name": "example.com"}}
+		},
+		"missing_arg": {"$call": "server"},
+		"unknown_arg": {"$call": "location", "args": {"@path": "/", "@nope": 1}},
+		"undefined": {"$call": "nope"},
+		"inner": {
+			"_only_here": {"$def": "only_here", "body": "here"},
+			"value": {"$call": "only_here"}
+		},
+		"outer": {"$call": "only_here"}
+	}`)
+	expectErrors(t, err, "/missing_arg", "/outer", "/undefined", "/unknown_arg")
+
+	expected := map[string]interface{}{
+		"/http/server/server_name":                   "example.com",
+		"/http/server/location/0/path":               "/",
+		"/http/server/location/0/backend":            "app",
+		"/http/server/location/0/proxy_pass":         "http://127.0.0.1",
+		"/http/server/location/0/proxy_read_timeout": "3",
+		"/http/server/location/1/path":               "/api",
+		"/http/server/location/1/backend":            "example.com",
+		"/inner/value":                               "here",
+	}
+	for path, value := range expected {
+		if v := result.Get(path); v != value {
+			t.Fatalf("%s did not preprocess right: %#v", path, v)
+		}
+	}
+	for _, key := range []string{"_location", "_server"} {
+		if _, exists := result.Get("/").(map[string]interface{})[key]; exists {
+			t.Fatalf("%s was not removed", key)
+		}
+	}
+
+	// definitions only last for the render they were declared in
+	_, err = preprocessJson(t, p, `{"server": {"$call": "server", "args": {"@name": "a"}}}`)
+	expectErrors(t, err, "/server")
+
+	_, err = preprocessJson(t, p, `{
+		"_forever": {"$def": "forever", "body": {"$call": "forever"}},
+		"forever": {"$call": "forever"}
+	}`)
+	if err == nil || !strings.Contains(err.Error(), "macros nested too deeply") {
+		t.Fatalf("recursive definition was not stopped: %v", err)
+	}
+}
+
+func TestPreprocessorTemplate(t *testing.T) {
+	p := newTestPreprocessor(t)
+	os.Setenv("CONFIGURATOR_TEST_LOG", "/var/log/nginx")
+	defer os.Unsetenv("CONFIGURATOR_TEST_LOG")
+
+	result, err := preprocessJson(t, p, `{
+		"_upstream": {"$set": ["@upstream", "app"]},
+		"port": {"$value": "/port", "as": "number"},
+		"servers": {"$value": "/servers.json", "as": "json"},
+		"log_format": {"$template": "{{env \"CONFIGURATOR_TEST_LOG\"}}/{{var \"@upstream\"}}.log"},
+		"listen": {"$template": "listen {{ref \"#port\"}}; # {{value \"/one\"}}"},
+		"upstream": {
+			"$template": "{{range $i, $s := .Data}}{{if $i}} {{end}}server {{$s}}:{{ref \"port\"}};{{end}}",
+			"data": {"$ref": "#servers"}
+		},
+		"env": {"$template": "{{.Env.CONFIGURATOR_TEST_LOG}}"},
+		"parse_error": {"$template": "{{if}}"},
+		"exec_error": {"$template": "{{value \"/missing\"}}"},
+		"missing_var": {"$template": "{{var \"@nope\"}}"},
+		"missing_env": {"$template": "{{.Env.CONFIGURATOR_TEST_MISSING}}"},
+		"cycle": {"$template": "{{ref \"#cycle\"}}"}
+	}`)
+	expectErrors(t, err, "/cycle", "/exec_error", "/missing_env", "/missing_var", "/parse_error")
+
+	expected := map[string]interface{}{
+		"/log_format": "/var/log/nginx/app.log",
+		"/listen":     "listen 8080; # 1",
+		"/upstream":   "server a:8080; server b:8080; server 1:8080;",
+		"/env":        "/var/log/nginx",
+	}
+	for path, value := range expected {
+		if v := result.Get(path); v != value {
+			t.Fatalf("%s did not preprocess right: %#v", path, v)
+		}
+	}
+
+	e := err.(*PreprocessError).Errors[4]
+	if !strings.Contains(e.Error(), "template: /parse_error:1:") {
+		t.Fatalf("parse error does not name the path: %v", e)
+	}
+}
+
+func TestPreprocessorInclude(t *testing.T) {
+	p := newTestPreprocessor(t)
+	file, err := ioutil.TempFile("", "configurator-test.")
+	if err != nil {
+		t.Fatalf("failed to make include file: %v", err)
+	}
+	defer os.Remove(file.Name())
+	file.WriteString(`{"listen": {"$ref": "#port"}, "name": {"$include": "/defaults.json"}}`)
+	file.Close()
+
+	result, err := preprocessJson(t, p, `{
+		"port": 80,
+		"frontend": {
+			"$merge": [{"$include": "/defaults.json"}, {"timeout": 10}]
+		},
+		"from_file": {"$include": "`+file.Name()+`", "from": "file"},
+		"cycle": {"$include": "/cycle/a.json"},
+		"missing": {"$include": "/missing.json"},
+		"not_json": {"$include": "/servers.txt"},
+		"bad_source": {"$include": "/defaults.json", "from": "nowhere"}
+	}`)
+	expectErrors(t, err, "/bad_source", "/cycle/b/a", "/missing", "/not_json")
+
+	expected := map[string]interface{}{
+		"/frontend/timeout":         float64(10),
+		"/frontend/servers/2":       "1",
+		"/from_file/listen":         float64(80),
+		"/from_file/name/timeout":   "3",
+		"/from_file/name/servers/0": "a",
+	}
+	for path, value := range expected {
+		if v := result.Get(path); v != value {
+			t.Fatalf("%s did not preprocess right: %#v", path, v)
+		}
+	}
+	if err.(*PreprocessError).Errors[1].Err.Error() != "cycle detected: /cycle/a.json -> /cycle/b.json -> /cycle/a.json" {
+		t.Fatalf("cycle error is not descriptive: %v", err)
+	}
+}
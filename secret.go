@@ -0,0 +1,55 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"io"
+	"io/ioutil"
+	"strings"
+
+	"golang.org/x/crypto/nacl/secretbox"
+)
+
+// Secrets are stored as base64 of a random nonce followed by the NaCl
+// secretbox of the value, sealed with a 32 byte key kept in a local file.
+
+const nonceSize = 24
+
+// loadSecretKey reads a base64 encoded 32 byte key from path.
+func loadSecretKey(path string) (*[32]byte, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	decoded, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(data)))
+	if err != nil || len(decoded) != 32 {
+		return nil, errors.New("secret key must be 32 bytes encoded as base64: " + path)
+	}
+	key := new([32]byte)
+	copy(key[:], decoded)
+	return key, nil
+}
+
+func encryptSecret(key *[32]byte, plaintext []byte) (string, error) {
+	var nonce [nonceSize]byte
+	if _, err := io.ReadFull(rand.Reader, nonce[:]); err != nil {
+		return "", err
+	}
+	sealed := secretbox.Seal(nonce[:], plaintext, &nonce, key)
+	return base64.StdEncoding.EncodeToString(sealed), nil
+}
+
+func decryptSecret(key *[32]byte, ciphertext string) (string, error) {
+	sealed, err := base64.StdEncoding.DecodeString(strings.TrimSpace(ciphertext))
+	if err != nil || len(sealed) < nonceSize+secretbox.Overhead {
+		return "", errors.New("secret is not valid ciphertext")
+	}
+	var nonce [nonceSize]byte
+	copy(nonce[:], sealed[:nonceSize])
+	plaintext, ok := secretbox.Open(nil, sealed[nonceSize:], &nonce, key)
+	if !ok {
+		return "", errors.New("secret could not be decrypted with the key")
+	}
+	return string(plaintext), nil
+}
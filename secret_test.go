@@ -0,0 +1,155 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"strings"
+	"testing"
+)
+
+const testSecretKey = "Y29uZmlndXJhdG9yLXRlc3Qta2V5LTAxMjM0NTY3ODk="
+
+func writeTempFile(t *testing.T, content string) string {
+	file, err := ioutil.TempFile("", "configurator-test.")
+	if err != nil {
+		t.Fatalf("failed to make temp file: %v", err)
+	}
+	file.WriteString(content)
+	file.Close()
+	return file.Name()
+}
+
+func TestSecretEncryption(t *testing.T) {
+	path := writeTempFile(t, testSecretKey+"\n")
+	defer os.Remove(path)
+	key, err := loadSecretKey(path)
+	if err != nil {
+		t.Fatalf("failed to load key: %v", err)
+	}
+
+	ciphertext, err := encryptSecret(key, []byte("hunter2"))
+	if err != nil {
+		t.Fatalf("failed to encrypt: %v", err)
+	}
+	if plaintext, err := decryptSecret(key, ciphertext); err != nil || plaintext != "hunter2" {
+		t.Fatalf("secret did not decrypt right: %#v %v", plaintext, err)
+	}
+
+	other := *key
+	other[0]++
+	if _, err := decryptSecret(&other, ciphertext); err == nil {
+		t.Fatalf("secret decrypted with the wrong key")
+	}
+	if _, err := decryptSecret(key, "hunter2"); err == nil {
+		t.Fatalf("plaintext was accepted as a secret")
+	}
+
+	short := writeTempFile(t, "c2hvcnQ=")
+	defer os.Remove(short)
+	if _, err := loadSecretKey(short); err == nil {
+		t.Fatalf("short key was accepted")
+	}
+}
+
+func TestSecretMacro(t *testing.T) {
+	config, err := NewConfig(NewTestStore(), "", "false", "", "")
+	if err != nil {
+		t.Fatalf("failed to make config: %v", err)
+	}
+	p := config.preprocessor
+
+	_, err = preprocessJson(t, p, `{"password": {"$secret": "/secrets/password"}}`)
+	expectErrors(t, err, "/password")
+
+	p.secretKey = new([32]byte)
+	copy(p.secretKey[:], "configurator-test-key-0123456789")
+	result, err := preprocessJson(t, p, `{
+		"password": {"$secret": "/secrets/password"},
+		"port": {"$secret": "/secrets/port", "as": "number"},
+		"not_a_bool": {"$secret": "/secrets/password", "as": "bool"},
+		"plaintext": {"$secret": "/one"},
+		"missing": {"$secret": "/missing"}
+	}`)
+	expectErrors(t, err, "/missing", "/not_a_bool", "/plaintext")
+
+	if v := result.Get("/password"); v != "hunter2" {
+		t.Fatalf("password did not preprocess right: %#v", v)
+	}
+	if v := result.Get("/port"); v != float64(5432) {
+		t.Fatalf("port did not preprocess right: %#v", v)
+	}
+	if strings.Contains(err.Error(), "hunter2") {
+		t.Fatalf("secret leaked into errors: %v", err)
+	}
+	derived := &JsonTree{}
+	derived.Load([]byte(`{"auth": {"$join": ["user", {"$secret": "/secrets/password"}], "sep": ":"}}`))
+	_, _, secrets, err := p.Render(derived)
+	expectErrors(t, err)
+	if redacted := secrets.Redact("auth user:hunter2; password hunter2;"); redacted != "auth [redacted]; password [redacted];" {
+		t.Fatalf("secret was not redacted: %s", redacted)
+	}
+
+	config.cmdRunner = func(cmd *exec.Cmd) error {
+		cmd.Stdout.Write([]byte("failed rendering hunter2"))
+		return cmd.Run()
+	}
+	config.Load([]byte(`{"password": {"$secret": "/secrets/password"}}`))
+	e, ok := config.Validate().(*ExecError)
+	if !ok {
+		t.Fatalf("transform did not fail")
+	}
+	if strings.Contains(e.Output, "hunter2") || strings.Contains(e.Input, "hunter2") {
+		t.Fatalf("secret leaked into transform error: %#v", e)
+	}
+}
+
+func TestSecretDerivedValues(t *testing.T) {
+	key := new([32]byte)
+	copy(key[:], "configurator-test-key-0123456789")
+	password, _ := encryptSecret(key, []byte("hunter2"))
+	creds, _ := encryptSecret(key, []byte(`{"user": "admin", "port": 80}`))
+	store := newCountingStore(map[string]string{"/password": password, "/creds": creds})
+	config, err := NewConfig(store, "", "", "", "")
+	if err != nil {
+		t.Fatalf("failed to make config: %v", err)
+	}
+	config.preprocessor.secretKey = key
+
+	input := &JsonTree{}
+	input.Load([]byte(`{
+		"base64": {"$base64": {"$secret": "/password"}},
+		"upper": {"$upper": {"$secret": "/password"}},
+		"split": {"$split": {"$secret": "/password"}, "sep": "t"},
+		"sha256": {"$sha256": {"$secret": "/password"}},
+		"length": {"$len": {"$secret": "/password"}},
+		"creds": {"$secret": "/creds", "as": "json"},
+		"bound": {
+			"_password": {"$set": ["@password", {"$secret": "/password"}]},
+			"upper": {"$upper": {"@password": null}}
+		},
+		"ref": {"$ref": "#bound/upper"},
+		"plain": {"$upper": "user"},
+		"broken": {"$add": [{"$secret": "/creds", "as": "json"}]},
+		"missing": {"$value": "/80"}
+	}`))
+	value, err := config.Eval(input.Get("/"))
+	expectErrors(t, err, "/broken", "/missing")
+	e := err.(*PreprocessError)
+	if e.Errors[0].Err.Error() != "failed on a value derived from a secret" || !strings.Contains(e.Errors[1].Err.Error(), "/80") {
+		t.Fatalf("errors were not redacted right: %v", err)
+	}
+
+	obj := value.(map[string]interface{})
+	for _, k := range []string{"base64", "upper", "split", "sha256", "length", "creds", "ref"} {
+		if obj[k] != "[redacted]" {
+			t.Fatalf("%s was not redacted: %#v", k, obj[k])
+		}
+	}
+	if upper := obj["bound"].(map[string]interface{})["upper"]; upper != "[redacted]" {
+		t.Fatalf("variable was not redacted: %#v", upper)
+	}
+	if obj["plain"] != "USER" {
+		t.Fatalf("value not derived from a secret was redacted: %#v", obj["plain"])
+	}
+}
@@ -5,15 +5,45 @@ import (
 	"log"
 	"net/url"
 	"os"
+	"path/filepath"
 )
 
 type ConfigStore interface {
-	Get(key string) string
+	Get(key string) (string, error)
+	Keys(prefix string) ([]string, error)
 	WatchToUpdate(config *Config, key string)
+	WatchKeysToUpdate(config *Config, prefix string)
+	// Unwatch stops the watch started for dep, be it by WatchToUpdate,
+	// WatchKeysToUpdate or the watches of a ServiceCatalog.
+	Unwatch(dep Dependency)
 	Pull(config *Config) error
 	Commit(config *Config, operation func() error) error
 }
 
+// ServiceCatalog is implemented by config stores that can also be used for
+// service discovery, as used by the $service and $services macros.
+type ServiceCatalog interface {
+	Services() (map[string][]string, error)
+	Service(name, tag string) ([]*ServiceInstance, error)
+	WatchServicesToUpdate(config *Config)
+	WatchServiceToUpdate(config *Config, name, tag string)
+}
+
+// PrefixFetcher is implemented by config stores that can get every value
+// under a prefix in one request, which is used to prefetch values.
+type PrefixFetcher interface {
+	GetPrefix(prefix string) (map[string]string, error)
+}
+
+type ServiceInstance struct {
+	ID      string
+	Name    string
+	Node    string
+	Address string
+	Port    int
+	Tags    []string
+}
+
 type FileStore struct {
 	path string
 }
@@ -27,23 +57,50 @@ func NewFileStore(uri *url.URL) (ConfigStore, error) {
 	}, nil
 }
 
-func (s *FileStore) Get(key string) string {
+func (s *FileStore) Get(key string) (string, error) {
 	bytes, err := ioutil.ReadFile(key)
+	if os.IsNotExist(err) {
+		return "", nil
+	}
 	if err != nil {
-		log.Println("filestore:", err)
+		return "", err
+	}
+	return string(bytes), nil
+}
+
+func (s *FileStore) Keys(prefix string) ([]string, error) {
+	files, err := ioutil.ReadDir(prefix)
+	if os.IsNotExist(err) {
+		return []string{}, nil
 	}
-	if len(bytes) > 0 {
-		return string(bytes)
+	if err != nil {
+		return nil, err
+	}
+	keys := make([]string, 0, len(files))
+	for _, file := range files {
+		keys = append(keys, filepath.Join(prefix, file.Name()))
 	}
-	return ""
+	return keys, nil
 }
 
 func (s *FileStore) WatchToUpdate(config *Config, key string) {
 	// twiddle our thumbs. we're not going to watch file changes. yet?
 }
 
+func (s *FileStore) WatchKeysToUpdate(config *Config, prefix string) {
+	// same goes for directories.
+}
+
+func (s *FileStore) Unwatch(dep Dependency) {
+	// nothing to stop.
+}
+
 func (s *FileStore) Pull(config *Config) error {
-	configData := s.Get(s.path)
+	configData, err := s.Get(s.path)
+	if err != nil {
+		log.Println("filestore:", err)
+		return err
+	}
 	if configData != "" {
 		err := config.Load([]byte(configData))
 		if err != nil {
@@ -1,31 +1,156 @@
 package main
 
+import (
+	"errors"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
 type TestStore struct{}
 
 func NewTestStore() *TestStore {
 	return &TestStore{}
 }
 
-func (s *TestStore) Get(key string) string {
+func (s *TestStore) Get(key string) (string, error) {
 	switch key {
 	case "/one":
-		return `1`
+		return `1`, nil
 	case "/two":
-		return `2`
+		return `2`, nil
 	case "/three":
-		return `3`
+		return `3`, nil
+	case "/vhosts/a.example.com":
+		return `server a`, nil
+	case "/vhosts/b.example.com":
+		return `server b`, nil
+	case "/port":
+		return "8080\n", nil
+	case "/enabled":
+		return `true`, nil
+	case "/servers.json":
+		return `["a", "b", {"$value": "/one"}]`, nil
+	case "/servers.txt":
+		return "a\nb\r\n\nc\n", nil
+	case "/servers.yaml":
+		return "servers:\n  - host: a\n    port: 80\n  - host: b\n    weight: 1.5\n8080: true\n", nil
+	case "/defaults.json":
+		return `{"timeout": {"$value": "/three"}, "servers": {"$include": "/servers.json"}}`, nil
+	case "/cycle/a.json":
+		return `{"b": {"$include": "/cycle/b.json"}}`, nil
+	case "/cycle/b.json":
+		return `{"a": {"$include": "/cycle/a.json"}}`, nil
+	case "/secrets/password":
+		return "Jg8+mzdJwxIvM9+Jjd+mEQVkoNsCRMzjvJaYSfvA7NqvtL9vQJOV6xBSK2O0HHA=", nil
+	case "/secrets/port":
+		return "cF0HjDKgrUBiWNwW7Guh7tvrg4Qc8kan3/2tiMGQ03HrUy9nafNXT0j1TSk=", nil
+	case "/unavailable":
+		return "", errors.New("store unavailable")
 	}
-	return ""
+	return "", nil
+}
+
+func (s *TestStore) Keys(prefix string) ([]string, error) {
+	switch prefix {
+	case "/vhosts", "/vhosts/":
+		return []string{"/vhosts/b.example.com", "/vhosts/a.example.com"}, nil
+	}
+	return []string{}, nil
 }
 
 func (s *TestStore) WatchToUpdate(config *Config, key string) {
 	// nope.
 }
 
+func (s *TestStore) WatchKeysToUpdate(config *Config, prefix string) {
+	// nope.
+}
+
+func (s *TestStore) Unwatch(dep Dependency) {
+	// nope.
+}
+
 func (s *TestStore) Pull(config *Config) error {
 	return nil
 }
 
 func (s *TestStore) Commit(config *Config, operation func() error) error {
-	return nil
+	return operation()
+}
+
+func TestFileStoreKeys(t *testing.T) {
+	dir, err := ioutil.TempDir("", "configurator-test.")
+	if err != nil {
+		t.Fatalf("failed to make temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	ioutil.WriteFile(filepath.Join(dir, "config"), []byte("{}"), 0644)
+	os.Mkdir(filepath.Join(dir, "vhosts"), 0755)
+	ioutil.WriteFile(filepath.Join(dir, "vhosts", "b.example.com"), []byte("server b"), 0644)
+	ioutil.WriteFile(filepath.Join(dir, "vhosts", "a.example.com"), []byte("server a"), 0644)
+
+	store, err := NewFileStore(&url.URL{Scheme: "file", Path: filepath.Join(dir, "config")})
+	if err != nil {
+		t.Fatalf("failed to make file store: %v", err)
+	}
+
+	keys, err := store.Keys(filepath.Join(dir, "vhosts"))
+	if err != nil {
+		t.Fatalf("failed to list keys: %v", err)
+	}
+	if len(keys) != 2 || keys[0] != filepath.Join(dir, "vhosts", "a.example.com") {
+		t.Fatalf("keys were not listed right: %#v", keys)
+	}
+	if value, _ := store.Get(keys[1]); value != "server b" {
+		t.Fatalf("listed key did not resolve: %#v", value)
+	}
+}
+
+// countingStore is a config store of fixed values that counts the requests
+// made to it.
+type countingStore struct {
+	TestStore
+	values map[string]string
+	gets   int
+	lists  int
+}
+
+func newCountingStore(values map[string]string) *countingStore {
+	return &countingStore{values: values}
+}
+
+func (s *countingStore) Get(key string) (string, error) {
+	s.gets++
+	return s.values[key], nil
+}
+
+func (s *countingStore) Keys(prefix string) ([]string, error) {
+	s.lists++
+	keys := make([]string, 0)
+	for key, _ := range s.values {
+		if strings.HasPrefix(key, prefix+"/") {
+			keys = append(keys, key)
+		}
+	}
+	return keys, nil
+}
+
+// prefetchingStore is a countingStore that can also get a prefix at once.
+type prefetchingStore struct {
+	*countingStore
+}
+
+func (s prefetchingStore) GetPrefix(prefix string) (map[string]string, error) {
+	s.lists++
+	values := make(map[string]string)
+	for key, value := range s.values {
+		if strings.HasPrefix(key, prefix+"/") {
+			values[key] = value
+		}
+	}
+	return values, nil
 }